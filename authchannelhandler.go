@@ -0,0 +1,106 @@
+package goricochet
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/s-rah/go-ricochet/auth"
+	"github.com/s-rah/go-ricochet/control"
+	"github.com/s-rah/go-ricochet/utils"
+)
+
+// AuthChannelHandler is the ChannelHandler for im.ricochet.auth.hidden-service
+// channels.
+type AuthChannelHandler struct {
+}
+
+// OnOpenChannelRequest validates a request to authenticate and passes the client
+// cookie on to the service.
+func (ach *AuthChannelHandler) OnOpenChannelRequest(oc *OpenConnection, service RicochetService, opm *Protocol_Data_Control.OpenChannel) {
+	if oc.Client {
+		// Servers are authed by default and can't auth with hidden-service
+		service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+	} else if oc.AuthState() != AuthNone {
+		// Can't auth if already authed, or open more than 1 auth channel
+		service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+	} else {
+		clientCookie, err := proto.GetExtension(opm, Protocol_Data_AuthHiddenService.E_ClientCookie)
+		if err == nil {
+			clientCookieB := [16]byte{}
+			copy(clientCookieB[:], clientCookie.([]byte)[:])
+			service.OnAuthenticationRequest(oc, opm.GetChannelIdentifier(), clientCookieB)
+		} else {
+			// Must include Client Cookie
+			service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+		}
+	}
+}
+
+// OnOpenChannelResult passes the server cookie on to the service so that a proof
+// can be constructed.
+func (ach *AuthChannelHandler) OnOpenChannelResult(oc *OpenConnection, service RicochetService, crm *Protocol_Data_Control.ChannelResult) {
+	if _, err := oc.expectAuthState(crm.GetChannelIdentifier(), AuthAwaitingChallenge); err != nil {
+		failAuthentication(oc, service, err)
+		return
+	}
+
+	serverCookie, err := proto.GetExtension(crm, Protocol_Data_AuthHiddenService.E_ServerCookie)
+	if err == nil {
+		serverCookieB := [16]byte{}
+		copy(serverCookieB[:], serverCookie.([]byte)[:])
+		service.OnAuthenticationChallenge(oc, crm.GetChannelIdentifier(), serverCookieB)
+	} else {
+		// Must include Server Cookie
+		failAuthentication(oc, service, utils.AuthenticationProtocolError)
+	}
+}
+
+// OnPacket handles proofs (from clients) and results (from servers).
+func (ach *AuthChannelHandler) OnPacket(oc *OpenConnection, service RicochetService, channelID int32, data []byte) {
+	res := new(Protocol_Data_AuthHiddenService.Packet)
+	err := proto.Unmarshal(data[:], res)
+
+	if err != nil {
+		oc.CloseChannel(channelID)
+		return
+	}
+
+	if res.GetProof() != nil && !oc.Client { // Only Clients Send Proofs
+		if _, err := oc.expectAuthState(channelID, AuthAwaitingProof); err != nil {
+			failAuthentication(oc, service, err)
+			return
+		}
+		service.OnAuthenticationProof(oc, channelID, res.GetProof().GetPublicKey(), res.GetProof().GetSignature())
+		ach.finish(oc, service, oc.IsAuthed())
+	} else if res.GetResult() != nil && oc.Client { // Only Servers Send Results
+		if _, err := oc.expectAuthState(channelID, AuthAwaitingResult); err != nil {
+			failAuthentication(oc, service, err)
+			return
+		}
+		oc.authenticationResultReceived(res.GetResult().GetAccepted(), res.GetResult().GetIsKnownContact())
+		service.OnAuthenticationResult(oc, channelID, res.GetResult().GetAccepted(), res.GetResult().GetIsKnownContact())
+		ach.finish(oc, service, oc.IsAuthed())
+	} else {
+		// If neither of the above are satisfied we just close the connection
+		failAuthentication(oc, service, utils.AuthenticationProtocolError)
+	}
+}
+
+// finish completes the handshake once the proof has been judged, closing the
+// connection if it was rejected.
+func (ach *AuthChannelHandler) finish(oc *OpenConnection, service RicochetService, accepted bool) {
+	if accepted {
+		oc.authenticationComplete()
+	} else {
+		failAuthentication(oc, service, utils.AuthenticationRejectedError)
+	}
+}
+
+// OnChannelClosed fails the handshake if the peer closes the authentication
+// channel before it has finished.
+func (ach *AuthChannelHandler) OnChannelClosed(oc *OpenConnection, service RicochetService, channelID int32) {
+	oc.lock.Lock()
+	abandoned := oc.auth.channel == channelID && oc.auth.state.waiting()
+	oc.lock.Unlock()
+	if abandoned {
+		failAuthentication(oc, service, utils.AuthenticationProtocolError)
+	}
+}
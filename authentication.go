@@ -0,0 +1,227 @@
+package goricochet
+
+import (
+	"github.com/s-rah/go-ricochet/utils"
+	"time"
+)
+
+const (
+	// DefaultAuthenticationTimeout is how long each step of the
+	// authentication handshake may take before the handshake fails.
+	DefaultAuthenticationTimeout = 30 * time.Second
+
+	// DefaultAuthenticationGracePeriod is how long a connection may remain
+	// unauthenticated before it is closed.
+	DefaultAuthenticationGracePeriod = time.Minute
+)
+
+// AuthState is the step a connection has reached in the hidden service
+// authentication handshake. Clients move from AuthNone through
+// AuthAwaitingChallenge and AuthAwaitingResult, servers through
+// AuthAwaitingProof, and both finish in AuthAccepted or AuthFailed. Only one
+// handshake may take place on a connection.
+type AuthState int
+
+const (
+	// AuthNone means the handshake has not started.
+	AuthNone AuthState = iota
+	// AuthAwaitingChallenge means the client has opened the authentication
+	// channel and is waiting for the server's cookie.
+	AuthAwaitingChallenge
+	// AuthAwaitingResult means the client has sent its proof and is waiting
+	// for the server's verdict.
+	AuthAwaitingResult
+	// AuthAwaitingProof means the server has accepted the authentication
+	// channel and is waiting for the client's proof.
+	AuthAwaitingProof
+	// AuthAccepted means the client's proof was accepted.
+	AuthAccepted
+	// AuthFailed means the handshake failed; the connection is closed.
+	AuthFailed
+)
+
+func (as AuthState) String() string {
+	switch as {
+	case AuthNone:
+		return "None"
+	case AuthAwaitingChallenge:
+		return "AwaitingChallenge"
+	case AuthAwaitingResult:
+		return "AwaitingResult"
+	case AuthAwaitingProof:
+		return "AwaitingProof"
+	case AuthAccepted:
+		return "Accepted"
+	case AuthFailed:
+		return "Failed"
+	}
+	return "Unknown"
+}
+
+// waiting returns true if the state is waiting on the peer, and so subject
+// to the authentication timeout.
+func (as AuthState) waiting() bool {
+	return as == AuthAwaitingChallenge || as == AuthAwaitingResult || as == AuthAwaitingProof
+}
+
+// authentication is the state of the authentication handshake on a
+// connection. It is protected by the connection's lock.
+type authentication struct {
+	state   AuthState
+	channel int32
+	handler *AuthenticationHandler
+	// entered is when state was entered, changed is closed and replaced on
+	// every transition.
+	entered time.Time
+	changed chan struct{}
+	// err is why the handshake failed.
+	err error
+}
+
+// AuthState returns the step the connection has reached in the
+// authentication handshake.
+func (oc *OpenConnection) AuthState() AuthState {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.auth.state
+}
+
+// authStatus returns the current step of the handshake, when it was entered,
+// and a channel which is closed when it changes.
+func (oc *OpenConnection) authStatus() (AuthState, time.Time, <-chan struct{}) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.auth.state, oc.auth.entered, oc.auth.changed
+}
+
+// setAuthState moves the handshake to state. Must be called with oc.lock held.
+func (oc *OpenConnection) setAuthState(state AuthState) {
+	oc.auth.state = state
+	oc.auth.entered = time.Now()
+	close(oc.auth.changed)
+	oc.auth.changed = make(chan struct{})
+}
+
+// beginAuthentication starts the handshake on channel, moving it from
+// AuthNone to state. Returns utils.AuthenticationProtocolError if a handshake
+// has already started.
+func (oc *OpenConnection) beginAuthentication(channel int32, state AuthState) (*AuthenticationHandler, error) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	if oc.auth.state != AuthNone {
+		return nil, utils.AuthenticationProtocolError
+	}
+	oc.auth.channel = channel
+	oc.auth.handler = new(AuthenticationHandler)
+	oc.setAuthState(state)
+	return oc.auth.handler, nil
+}
+
+// expectAuthState returns the handshake's AuthenticationHandler if the
+// handshake is on channel and has reached state, otherwise
+// utils.AuthenticationProtocolError.
+func (oc *OpenConnection) expectAuthState(channel int32, state AuthState) (*AuthenticationHandler, error) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	if oc.auth.state != state || oc.auth.channel != channel {
+		return nil, utils.AuthenticationProtocolError
+	}
+	return oc.auth.handler, nil
+}
+
+// advanceAuthentication moves the handshake from state from to state to,
+// returning false if it is no longer in state from.
+func (oc *OpenConnection) advanceAuthentication(from AuthState, to AuthState) bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	if oc.auth.state != from {
+		return false
+	}
+	oc.setAuthState(to)
+	return true
+}
+
+// authenticationComplete records that the handshake succeeded, registers the
+// connection and wakes anyone waiting in WaitForAuthentication.
+func (oc *OpenConnection) authenticationComplete() {
+	oc.lock.Lock()
+	if oc.auth.state == AuthAccepted || oc.auth.state == AuthFailed {
+		oc.lock.Unlock()
+		return
+	}
+	oc.setAuthState(AuthAccepted)
+	registry := oc.registry
+	oc.lock.Unlock()
+
+	if registry != nil {
+		registry.add(oc)
+	}
+	close(oc.authDone)
+}
+
+// authenticationFailed records that the handshake failed because of reason,
+// returning false if it had already finished.
+func (oc *OpenConnection) authenticationFailed(reason error) bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	if oc.auth.state == AuthAccepted || oc.auth.state == AuthFailed {
+		return false
+	}
+	oc.auth.err = reason
+	oc.setAuthState(AuthFailed)
+	close(oc.authDone)
+	return true
+}
+
+// failAuthentication fails the handshake on oc, tells the service why and
+// closes the connection.
+func failAuthentication(oc *OpenConnection, service RicochetService, reason error) {
+	if oc.authenticationFailed(reason) {
+		service.OnAuthenticationFailed(oc, reason)
+	}
+	oc.Close()
+}
+
+// watchAuthentication fails the handshake on oc if any step of it takes
+// longer than timeout, or if oc has not authenticated within gracePeriod. A
+// zero duration disables the corresponding limit. It returns once the
+// handshake has finished or stop is closed.
+func watchAuthentication(oc *OpenConnection, service RicochetService, timeout time.Duration, gracePeriod time.Duration, stop chan struct{}) {
+	var grace <-chan time.Time
+	if gracePeriod > 0 {
+		timer := time.NewTimer(gracePeriod)
+		defer timer.Stop()
+		grace = timer.C
+	}
+
+	for {
+		state, entered, changed := oc.authStatus()
+		if state == AuthAccepted || state == AuthFailed {
+			return
+		}
+
+		var step <-chan time.Time
+		var stepTimer *time.Timer
+		if state.waiting() && timeout > 0 {
+			stepTimer = time.NewTimer(time.Until(entered.Add(timeout)))
+			step = stepTimer.C
+		}
+
+		select {
+		case <-stop:
+		case <-changed:
+		case <-step:
+			failAuthentication(oc, service, utils.AuthenticationTimeoutError)
+		case <-grace:
+			failAuthentication(oc, service, utils.AuthenticationGracePeriodError)
+		}
+		if stepTimer != nil {
+			stepTimer.Stop()
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package goricochet
+
+import "testing"
+import "time"
+import "context"
+import "net"
+import "github.com/s-rah/go-ricochet/identity"
+import "github.com/s-rah/go-ricochet/utils"
+
+// TestAuthService records authentication failures, and can be made to stall
+// the authentication handshake.
+type TestAuthService struct {
+	StandardRicochetService
+	Failures      chan error
+	AuthChannel   int32
+	WithholdProof bool
+}
+
+func (ts *TestAuthService) OnConnect(oc *OpenConnection) {
+	if oc.Client && ts.AuthChannel != 0 {
+		oc.SetMyHostname(ts.serverHostname)
+		if ts.AuthChannel > 0 {
+			oc.Authenticate(ts.AuthChannel)
+		}
+		return
+	}
+	ts.StandardRicochetService.OnConnect(oc)
+}
+
+func (ts *TestAuthService) OnAuthenticationChallenge(oc *OpenConnection, channelID int32, serverCookie [16]byte) {
+	if !ts.WithholdProof {
+		ts.StandardRicochetService.OnAuthenticationChallenge(oc, channelID, serverCookie)
+	}
+}
+
+func (ts *TestAuthService) OnAuthenticationFailed(oc *OpenConnection, reason error) {
+	ts.StandardRicochetService.OnAuthenticationFailed(oc, reason)
+	ts.Failures <- reason
+}
+
+func newTestAuthService(t *testing.T, port int) *TestAuthService {
+	ricochetService := new(TestAuthService)
+	if err := ricochetService.Init("./private_key"); err != nil {
+		t.Fatalf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.Failures = make(chan error, 10)
+	go ricochetService.Listen(ricochetService, port)
+	return ricochetService
+}
+
+func expectAuthFailure(t *testing.T, ts *TestAuthService, expected error) {
+	select {
+	case reason := <-ts.Failures:
+		if reason != expected {
+			t.Errorf("Expected authentication to fail with %v, got %v", expected, reason)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("Expected authentication to fail with %v", expected)
+	}
+}
+
+func TestAuthenticationStepTimeout(t *testing.T) {
+	ricochetService := newTestAuthService(t, 9928)
+	ricochetService.SetAuthenticationTimeouts(time.Millisecond*200, 0)
+	ricochetService2 := newTestAuthService(t, 9929)
+	ricochetService2.WithholdProof = true
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := ricochetService2.ConnectContext(ctx, "127.0.0.1:9928|kwke2hntvyfqm7dr"); err != utils.ConnectionClosedError {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+	expectAuthFailure(t, ricochetService, utils.AuthenticationTimeoutError)
+}
+
+func TestAuthenticationGracePeriod(t *testing.T) {
+	ricochetService := newTestAuthService(t, 9930)
+	ricochetService.SetAuthenticationTimeouts(0, time.Millisecond*300)
+	ricochetService2 := newTestAuthService(t, 9931)
+	ricochetService2.AuthChannel = -1 // Never authenticate
+	time.Sleep(time.Millisecond * 100)
+
+	oc, err := ricochetService2.Connect("127.0.0.1:9930|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+	expectAuthFailure(t, ricochetService, utils.AuthenticationGracePeriodError)
+	select {
+	case <-oc.Done():
+	case <-time.After(time.Second * 2):
+		t.Errorf("Expected the unauthenticated connection to be closed")
+	}
+}
+
+func TestAuthenticationChannel(t *testing.T) {
+	newTestAuthService(t, 9932)
+	ricochetService2 := newTestAuthService(t, 9933)
+	ricochetService2.AuthChannel = 7
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	oc, err := ricochetService2.ConnectContext(ctx, "127.0.0.1:9932|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Fatalf("Could not authenticate on channel 7: %v", err)
+	}
+	if oc.AuthState() != AuthAccepted {
+		t.Errorf("Expected authentication to have been accepted, got %v", oc.AuthState())
+	}
+	if err := oc.Authenticate(9); err != utils.AuthenticationProtocolError {
+		t.Errorf("Expected a second handshake to be refused, got %v", err)
+	}
+}
+
+func TestAuthenticationFacts(t *testing.T) {
+	ricochetService := newTestAuthService(t, 9934)
+	ricochetService.AddContact("kwke2hntvyfqm7dr", "kwke")
+	ricochetService2 := newTestAuthService(t, 9935)
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	oc, err := ricochetService2.ConnectContext(ctx, "127.0.0.1:9934|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+	if oc.DialledHostname() != "kwke2hntvyfqm7dr" || !oc.ProvedOwnIdentity() || oc.PeerProvedIdentity() || !oc.KnownToPeer() || !oc.IsAuthed() {
+		t.Errorf("Unexpected client facts: dialled %v, proved own %v, peer proved %v, known %v", oc.DialledHostname(), oc.ProvedOwnIdentity(), oc.PeerProvedIdentity(), oc.KnownToPeer())
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	inbound := ricochetService.Connection("kwke2hntvyfqm7dr")
+	if inbound == nil {
+		t.Fatalf("Expected the server to have authenticated the client")
+	}
+	if inbound.DialledHostname() != "" || inbound.ProvedOwnIdentity() || !inbound.PeerProvedIdentity() || !inbound.IsAuthed() {
+		t.Errorf("Unexpected server facts: dialled %v, proved own %v, peer proved %v", inbound.DialledHostname(), inbound.ProvedOwnIdentity(), inbound.PeerProvedIdentity())
+	}
+}
+
+func TestOutboundNotAuthedByDefault(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	oc := new(OpenConnection)
+	oc.Init(true, conn)
+	defer oc.Close()
+
+	// A server we dialled has not authenticated us until it accepts our proof
+	oc.SetAuthed(true)
+	if oc.IsAuthed() {
+		t.Errorf("Expected an outbound connection not to be authenticated before the server accepts our proof")
+	}
+	oc.authenticationResultReceived(true, false)
+	if !oc.IsAuthed() || oc.KnownToPeer() {
+		t.Errorf("Expected an outbound connection to be authenticated once our proof is accepted")
+	}
+}
+
+type authenticationResult struct {
+	Accepted       bool
+	IsKnownContact bool
+}
+
+// TestForgedProofService claims to be Forge in its authentication proof,
+// without holding Forge's key.
+type TestForgedProofService struct {
+	StandardRicochetService
+	Forge   *identity.Identity
+	Results chan authenticationResult
+}
+
+func (ts *TestForgedProofService) OnAuthenticationChallenge(oc *OpenConnection, channelID int32, serverCookie [16]byte) {
+	messageBuilder := new(MessageBuilder)
+	data, _ := messageBuilder.Proof(ts.Forge.Bytes(), make([]byte, 64))
+	if oc.advanceAuthentication(AuthAwaitingChallenge, AuthAwaitingResult) {
+		oc.send(channelID, data)
+	}
+}
+
+func (ts *TestForgedProofService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
+	ts.StandardRicochetService.OnAuthenticationResult(oc, channelID, result, isKnownContact)
+	ts.Results <- authenticationResult{result, isKnownContact}
+}
+
+func TestForgedProofNotKnownContact(t *testing.T) {
+	contact, err := identity.Generate(identity.V3)
+	if err != nil {
+		t.Fatalf("Could not generate identity: %v", err)
+	}
+	ricochetService := newTestAuthService(t, 9939)
+	ricochetService.AddContact(contact.Hostname(), "contact")
+
+	ricochetService2 := new(TestForgedProofService)
+	if err := ricochetService2.Init("./private_key"); err != nil {
+		t.Fatalf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService2.Forge = contact
+	ricochetService2.Results = make(chan authenticationResult, 1)
+	go ricochetService2.Listen(ricochetService2, 9940)
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := ricochetService2.ConnectContext(ctx, "127.0.0.1:9939|kwke2hntvyfqm7dr"); err == nil {
+		t.Errorf("Expected a forged proof not to authenticate")
+	}
+	select {
+	case result := <-ricochetService2.Results:
+		if result.Accepted || result.IsKnownContact {
+			t.Errorf("Expected a forged proof for a known contact to be rejected as unknown, got %+v", result)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("Expected an authentication result")
+	}
+}
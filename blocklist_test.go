@@ -0,0 +1,123 @@
+package goricochet
+
+import "testing"
+import "time"
+import "context"
+import "github.com/s-rah/go-ricochet/utils"
+
+func TestBlockedPeerFailsAuthentication(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.BlockContact("kwke2hntvyfqm7dr")
+	go ricochetService.Listen(ricochetService, 9922)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(StandardRicochetService)
+	ricochetService2.Init("./private_key")
+	go ricochetService2.Listen(ricochetService2, 9923)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err = ricochetService2.ConnectContext(ctx, "127.0.0.1:9922|kwke2hntvyfqm7dr")
+	if err != utils.AuthenticationRejectedError {
+		t.Errorf("Expected a blocked peer to be refused, got %v", err)
+	}
+	if ricochetService.Connection("kwke2hntvyfqm7dr") != nil {
+		t.Errorf("Expected no connection to the blocked peer")
+	}
+
+	// Once unblocked the peer can authenticate
+	ricochetService.UnblockContact("kwke2hntvyfqm7dr")
+	oc, err := ricochetService2.ConnectContext(ctx, "127.0.0.1:9922|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Fatalf("Expected an unblocked peer to connect, got %v", err)
+	}
+
+	// Blocking a connected peer disconnects it
+	time.Sleep(time.Millisecond * 100)
+	ricochetService.BlockContact("kwke2hntvyfqm7dr")
+	select {
+	case <-oc.Done():
+	case <-time.After(time.Second * 2):
+		t.Errorf("Expected blocking to close the connection")
+	}
+}
+
+func TestBlockedPeerOutbound(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.AddContact("kwke2hntvyfqm7dr", "kwke")
+	ricochetService.BlockContact("ricochet:kwke2hntvyfqm7dr")
+
+	if _, err := ricochetService.Connect("127.0.0.1:9924|kwke2hntvyfqm7dr"); err != utils.BlockedError {
+		t.Errorf("Expected BlockedError connecting to a blocked peer, got %v", err)
+	}
+	if ricochetService.IsKnownContact("kwke2hntvyfqm7dr") {
+		t.Errorf("Expected a blocked contact not to be known")
+	}
+
+	ricochetService.UnblockContact("kwke2hntvyfqm7dr")
+	if !ricochetService.IsKnownContact("kwke2hntvyfqm7dr") {
+		t.Errorf("Expected an unblocked contact to be known again")
+	}
+}
+
+// exactContactStore is a ContactStore which, unlike MemoryContactStore, does
+// not normalise hostnames.
+type exactContactStore map[string]Contact
+
+func (ecs exactContactStore) GetContact(hostname string) (Contact, bool) {
+	contact, exists := ecs[hostname]
+	return contact, exists
+}
+
+func (ecs exactContactStore) Contacts() []Contact {
+	var contacts []Contact
+	for _, contact := range ecs {
+		contacts = append(contacts, contact)
+	}
+	return contacts
+}
+
+func (ecs exactContactStore) SaveContact(contact Contact) error {
+	ecs[contact.Hostname] = contact
+	return nil
+}
+
+func (ecs exactContactStore) RemoveContact(hostname string) error {
+	delete(ecs, hostname)
+	return nil
+}
+
+func TestIsBlockedHostnameForms(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.SetContactStore(make(exactContactStore))
+	ricochetService.BlockContact("kwke2hntvyfqm7dr.onion")
+
+	for _, hostname := range []string{
+		"kwke2hntvyfqm7dr",
+		"ricochet:kwke2hntvyfqm7dr",
+		"kwke2hntvyfqm7dr.onion",
+		"kwke2hntvyfqm7dr.onion:9878",
+		"KWKE2HNTVYFQM7DR.onion",
+		"127.0.0.1:9878|kwke2hntvyfqm7dr",
+	} {
+		if !ricochetService.IsBlocked(hostname) {
+			t.Errorf("Expected %v to be blocked", hostname)
+		}
+	}
+	if _, err := ricochetService.Connect("kwke2hntvyfqm7dr.onion:9878"); err != utils.BlockedError {
+		t.Errorf("Expected BlockedError connecting to a blocked peer, got %v", err)
+	}
+}
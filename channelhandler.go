@@ -0,0 +1,26 @@
+package goricochet
+
+import (
+	"github.com/s-rah/go-ricochet/control"
+)
+
+// ChannelHandler implements the behaviour of a single channel type (e.g.
+// im.ricochet.chat). Handlers are registered with a Ricochet instance against
+// the channel type they process, and every event for a channel of that type
+// is passed to the registered handler.
+type ChannelHandler interface {
+	// OnOpenChannelRequest is called when the peer requests a new channel of
+	// this type. Channel identifier checks (in use, odd/even) have already
+	// been performed.
+	OnOpenChannelRequest(oc *OpenConnection, service RicochetService, opm *Protocol_Data_Control.OpenChannel)
+
+	// OnOpenChannelResult is called when the peer accepts a request to open
+	// a channel of this type.
+	OnOpenChannelResult(oc *OpenConnection, service RicochetService, crm *Protocol_Data_Control.ChannelResult)
+
+	// OnPacket is called for every packet received on a channel of this type.
+	OnPacket(oc *OpenConnection, service RicochetService, channelID int32, data []byte)
+
+	// OnChannelClosed is called when the peer closes a channel of this type.
+	OnChannelClosed(oc *OpenConnection, service RicochetService, channelID int32)
+}
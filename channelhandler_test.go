@@ -0,0 +1,85 @@
+package goricochet
+
+import "testing"
+import "time"
+import "sync"
+import "github.com/s-rah/go-ricochet/control"
+
+// TestEchoChannelHandler implements a trivial custom channel type which the
+// server accepts and records packets for.
+type TestEchoChannelHandler struct {
+	lock     sync.Mutex
+	Opened   bool
+	Received string
+	Closed   bool
+}
+
+func (tech *TestEchoChannelHandler) OnOpenChannelRequest(oc *OpenConnection, service RicochetService, opm *Protocol_Data_Control.OpenChannel) {
+	oc.AckOpenChannel(opm.GetChannelIdentifier(), opm.GetChannelType())
+}
+
+func (tech *TestEchoChannelHandler) OnOpenChannelResult(oc *OpenConnection, service RicochetService, crm *Protocol_Data_Control.ChannelResult) {
+	tech.lock.Lock()
+	tech.Opened = true
+	tech.lock.Unlock()
+	oc.SendPacket(crm.GetChannelIdentifier(), []byte("hello"))
+	oc.CloseChannel(crm.GetChannelIdentifier())
+}
+
+func (tech *TestEchoChannelHandler) OnPacket(oc *OpenConnection, service RicochetService, channelID int32, data []byte) {
+	tech.lock.Lock()
+	tech.Received = string(data)
+	tech.lock.Unlock()
+}
+
+func (tech *TestEchoChannelHandler) OnChannelClosed(oc *OpenConnection, service RicochetService, channelID int32) {
+	tech.lock.Lock()
+	tech.Closed = true
+	tech.lock.Unlock()
+}
+
+type TestChannelHandlerService struct {
+	StandardRicochetService
+}
+
+func (ts *TestChannelHandlerService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
+	ts.StandardRicochetService.OnAuthenticationResult(oc, channelID, result, isKnownContact)
+	oc.OpenChannel(7, "im.ricochet.test.echo")
+}
+
+func TestChannelHandler(t *testing.T) {
+	serverHandler := new(TestEchoChannelHandler)
+	ricochetService := new(TestChannelHandlerService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.RegisterChannelHandler("im.ricochet.test.echo", serverHandler)
+
+	go ricochetService.Listen(ricochetService, 9886)
+
+	time.Sleep(time.Second * 2)
+
+	clientHandler := new(TestEchoChannelHandler)
+	ricochetService2 := new(TestChannelHandlerService)
+	err = ricochetService2.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService2.RegisterChannelHandler("im.ricochet.test.echo", clientHandler)
+
+	go ricochetService2.Listen(ricochetService2, 9887)
+	_, err = ricochetService2.Connect("127.0.0.1:9886|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect to ricochet service:  %v", err)
+	}
+
+	time.Sleep(time.Second * 2)
+	clientHandler.lock.Lock()
+	defer clientHandler.lock.Unlock()
+	serverHandler.lock.Lock()
+	defer serverHandler.lock.Unlock()
+	if !clientHandler.Opened || serverHandler.Received != "hello" || !serverHandler.Closed {
+		t.Errorf("Custom channel handler was not used: opened %v, received %q, closed %v", clientHandler.Opened, serverHandler.Received, serverHandler.Closed)
+	}
+}
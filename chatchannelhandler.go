@@ -0,0 +1,79 @@
+package goricochet
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/s-rah/go-ricochet/chat"
+	"github.com/s-rah/go-ricochet/control"
+	"time"
+)
+
+// ChatChannelHandler is the ChannelHandler for im.ricochet.chat channels.
+type ChatChannelHandler struct {
+}
+
+// OnOpenChannelRequest only allows authenticated, known contacts to open chat
+// channels.
+func (cch *ChatChannelHandler) OnOpenChannelRequest(oc *OpenConnection, service RicochetService, opm *Protocol_Data_Control.OpenChannel) {
+	if !oc.IsAuthed() {
+		// Can't open chat channel if not authorized
+		service.OnUnauthorizedError(oc, opm.GetChannelIdentifier())
+	} else if !service.IsKnownContact(oc.OtherHostname()) {
+		// Can't open chat channel if not a known contact
+		service.OnUnauthorizedError(oc, opm.GetChannelIdentifier())
+	} else {
+		service.OnOpenChannelRequest(oc, opm.GetChannelIdentifier(), "im.ricochet.chat")
+	}
+}
+
+// OnOpenChannelResult notifies the service that a chat channel is ready for use.
+func (cch *ChatChannelHandler) OnOpenChannelResult(oc *OpenConnection, service RicochetService, crm *Protocol_Data_Control.ChannelResult) {
+	service.OnOpenChannelRequestSuccess(oc, crm.GetChannelIdentifier())
+}
+
+// OnPacket handles chat messages and acknowledgements.
+func (cch *ChatChannelHandler) OnPacket(oc *OpenConnection, service RicochetService, channelID int32, data []byte) {
+	// NOTE: These auth checks should be redundant, however they
+	// are included here for defense-in-depth if for some reason
+	// a previously authed connection becomes untrusted / not known and
+	// the state is not cleaned up.
+	if !oc.IsAuthed() {
+		// Can't send chat messages if not authorized
+		service.OnUnauthorizedError(oc, channelID)
+	} else if !service.IsKnownContact(oc.OtherHostname()) {
+		// Can't send chat message if not a known contact
+		service.OnUnauthorizedError(oc, channelID)
+	} else {
+		res := new(Protocol_Data_Chat.Packet)
+		err := proto.Unmarshal(data[:], res)
+
+		if err != nil {
+			oc.CloseChannel(channelID)
+			return
+		}
+
+		if res.GetChatMessage() != nil {
+			message := res.GetChatMessage()
+			if err := checkMessageLength(message.GetMessageText()); err != nil {
+				oc.RejectChatMessage(channelID, int32(message.GetMessageId()))
+				service.OnLimitExceeded(oc, channelID, err)
+				return
+			}
+			written := time.Now()
+			// Messages can only have been written in the past
+			if message.GetTimeDelta() < 0 {
+				written = written.Add(time.Duration(message.GetTimeDelta()) * time.Second)
+			}
+			service.OnChatMessage(oc, channelID, int32(message.GetMessageId()), message.GetMessageText(), written)
+		} else if res.GetChatAcknowledge() != nil {
+			ack := res.GetChatAcknowledge()
+			service.OnChatMessageAck(oc, channelID, int32(ack.GetMessageId()), ack.GetAccepted())
+		} else {
+			// If neither of the above are satisfied we just close the connection
+			oc.Close()
+		}
+	}
+}
+
+// OnChannelClosed is a NoOp for chat channels.
+func (cch *ChatChannelHandler) OnChannelClosed(oc *OpenConnection, service RicochetService, channelID int32) {
+}
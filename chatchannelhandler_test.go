@@ -0,0 +1,141 @@
+package goricochet
+
+import "testing"
+import "time"
+
+type chatAck struct {
+	messageID int32
+	accepted  bool
+}
+
+type ChatAckTestService struct {
+	StandardRicochetService
+	sent chan int32
+	acks chan chatAck
+}
+
+func (cats *ChatAckTestService) IsKnownContact(hostname string) bool {
+	return true
+}
+
+func (cats *ChatAckTestService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
+	cats.StandardRicochetService.OnAuthenticationResult(oc, channelID, result, isKnownContact)
+	oc.OpenChatChannel(5)
+}
+
+func (cats *ChatAckTestService) OnOpenChannelRequestSuccess(oc *OpenConnection, channelID int32) {
+	for _, message := range []string{"ACCEPT", "REJECT"} {
+		messageID, err := oc.SendMessage(channelID, message)
+		if err == nil {
+			cats.sent <- messageID
+		}
+	}
+}
+
+func (cats *ChatAckTestService) OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string, written time.Time) {
+	if message == "REJECT" {
+		oc.RejectChatMessage(channelID, messageID)
+	} else {
+		oc.AckChatMessage(channelID, messageID)
+	}
+}
+
+func (cats *ChatAckTestService) OnChatMessageAck(oc *OpenConnection, channelID int32, messageID int32, accepted bool) {
+	cats.acks <- chatAck{messageID, accepted}
+}
+
+func TestChatMessageAck(t *testing.T) {
+	ricochetService := new(ChatAckTestService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9910)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(ChatAckTestService)
+	ricochetService2.Init("./private_key")
+	ricochetService2.sent = make(chan int32, 2)
+	ricochetService2.acks = make(chan chatAck, 2)
+	go ricochetService2.Listen(ricochetService2, 9911)
+
+	_, err = ricochetService2.Connect("127.0.0.1:9910|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect to ricochet service: %v", err)
+	}
+
+	expected := []chatAck{{1, true}, {2, false}}
+	for _, e := range expected {
+		select {
+		case messageID := <-ricochetService2.sent:
+			if messageID != e.messageID {
+				t.Errorf("Expected message to be sent with ID %v, got %v", e.messageID, messageID)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Timed out waiting for message to be sent")
+		}
+	}
+	for _, e := range expected {
+		select {
+		case ack := <-ricochetService2.acks:
+			if ack != e {
+				t.Errorf("Expected ack %v, got %v", e, ack)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Timed out waiting for ack of message %v", e.messageID)
+		}
+	}
+}
+
+type ChatTimeTestService struct {
+	StandardRicochetService
+	written chan time.Time
+}
+
+func (ctts *ChatTimeTestService) IsKnownContact(hostname string) bool {
+	return true
+}
+
+func (ctts *ChatTimeTestService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
+	ctts.StandardRicochetService.OnAuthenticationResult(oc, channelID, result, isKnownContact)
+	oc.OpenChatChannel(5)
+}
+
+func (ctts *ChatTimeTestService) OnOpenChannelRequestSuccess(oc *OpenConnection, channelID int32) {
+	oc.SendMessageAt(channelID, "written an hour ago", time.Now().Add(-time.Hour))
+}
+
+func (ctts *ChatTimeTestService) OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string, written time.Time) {
+	ctts.written <- written
+}
+
+func TestChatMessageWrittenTime(t *testing.T) {
+	ricochetService := new(ChatTimeTestService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.written = make(chan time.Time, 1)
+	go ricochetService.Listen(ricochetService, 9914)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(ChatTimeTestService)
+	ricochetService2.Init("./private_key")
+	go ricochetService2.Listen(ricochetService2, 9915)
+
+	_, err = ricochetService2.Connect("127.0.0.1:9914|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect to ricochet service: %v", err)
+	}
+
+	select {
+	case written := <-ricochetService.written:
+		if age := time.Since(written); age < time.Hour-time.Minute || age > time.Hour+time.Minute {
+			t.Errorf("Expected message to have been written an hour ago, was %v ago", age)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for message")
+	}
+}
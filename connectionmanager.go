@@ -0,0 +1,264 @@
+package goricochet
+
+import (
+	"context"
+	"github.com/s-rah/go-ricochet/utils"
+	"log"
+	"sync"
+	"time"
+)
+
+// PeerState describes the connection to a peer managed by a ConnectionManager.
+type PeerState int
+
+const (
+	// PeerDisconnected means there is no connection and none is being attempted.
+	PeerDisconnected PeerState = iota
+	// PeerConnecting means a connection is being established and authenticated.
+	PeerConnecting
+	// PeerConnected means there is a live, authenticated connection to the peer.
+	PeerConnected
+	// PeerBackoff means the last attempt failed and the next will be made
+	// after a delay.
+	PeerBackoff
+)
+
+func (ps PeerState) String() string {
+	switch ps {
+	case PeerDisconnected:
+		return "Disconnected"
+	case PeerConnecting:
+		return "Connecting"
+	case PeerConnected:
+		return "Connected"
+	case PeerBackoff:
+		return "Backoff"
+	}
+	return "Unknown"
+}
+
+// Default parameters for a ConnectionManager
+const (
+	DefaultMinBackoff     = time.Second
+	DefaultMaxBackoff     = time.Minute * 5
+	DefaultConnectTimeout = time.Minute
+)
+
+// managedPeer is the state kept for each peer in the desired set.
+type managedPeer struct {
+	address string
+	state   PeerState
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// wake is signalled when the peer connects to us.
+	wake chan struct{}
+}
+
+// ConnectionManager maintains authenticated connections to a set of peers on
+// behalf of a StandardRicochetService. Failed or dropped connections are
+// retried with exponential backoff. A connection made by the peer to us counts
+// as connected; the service ensures only one connection per peer is kept.
+//
+// The exported fields should be set before the first call to AddPeer.
+type ConnectionManager struct {
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	ConnectTimeout time.Duration
+
+	// OnStateChange, if set, is called whenever the state of a peer changes.
+	OnStateChange func(hostname string, state PeerState)
+
+	srs   *StandardRicochetService
+	lock  sync.Mutex
+	peers map[string]*managedPeer
+}
+
+// newConnectionManager creates a ConnectionManager which connects using srs.
+func newConnectionManager(srs *StandardRicochetService) *ConnectionManager {
+	cm := new(ConnectionManager)
+	cm.MinBackoff = DefaultMinBackoff
+	cm.MaxBackoff = DefaultMaxBackoff
+	cm.ConnectTimeout = DefaultConnectTimeout
+	cm.srs = srs
+	cm.peers = make(map[string]*managedPeer)
+	return cm
+}
+
+// AddPeer adds a peer to the set the manager keeps connected to. The address
+// may be in any form accepted by Connect e.g. "127.0.0.1:9878|jlq67qzo6s4yp3sp".
+// A peer which turns out to be blocked is dropped from the set.
+func (cm *ConnectionManager) AddPeer(address string) {
+	hostname := utils.ParseOnionHostname(address)
+
+	cm.lock.Lock()
+	if _, exists := cm.peers[hostname]; exists {
+		cm.lock.Unlock()
+		return
+	}
+	peer := &managedPeer{address: address, state: PeerDisconnected, wake: make(chan struct{}, 1)}
+	peer.ctx, peer.cancel = context.WithCancel(context.Background())
+	cm.peers[hostname] = peer
+	cm.lock.Unlock()
+
+	go cm.maintain(hostname, peer)
+}
+
+// RemovePeer stops maintaining a connection to the peer, and closes any
+// connection to it.
+func (cm *ConnectionManager) RemovePeer(hostname string) {
+	hostname = utils.ParseOnionHostname(hostname)
+
+	cm.lock.Lock()
+	peer, exists := cm.peers[hostname]
+	delete(cm.peers, hostname)
+	cm.lock.Unlock()
+
+	if exists {
+		peer.cancel()
+		if oc := cm.srs.Connection(hostname); oc != nil {
+			oc.Close()
+		}
+	}
+}
+
+// Stop removes all peers from the manager.
+func (cm *ConnectionManager) Stop() {
+	for _, hostname := range cm.Peers() {
+		cm.RemovePeer(hostname)
+	}
+}
+
+// abandon stops maintaining all peers, leaving their connections open.
+func (cm *ConnectionManager) abandon() {
+	cm.lock.Lock()
+	peers := cm.peers
+	cm.peers = make(map[string]*managedPeer)
+	cm.lock.Unlock()
+
+	for _, peer := range peers {
+		peer.cancel()
+	}
+}
+
+// Peers returns the hostnames of all managed peers.
+func (cm *ConnectionManager) Peers() []string {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	hostnames := make([]string, 0, len(cm.peers))
+	for hostname := range cm.peers {
+		hostnames = append(hostnames, hostname)
+	}
+	return hostnames
+}
+
+// State returns the state of the connection to a managed peer.
+func (cm *ConnectionManager) State(hostname string) PeerState {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if peer, exists := cm.peers[utils.ParseOnionHostname(hostname)]; exists {
+		return peer.state
+	}
+	return PeerDisconnected
+}
+
+// maintain keeps the peer connected until it is removed from the manager.
+func (cm *ConnectionManager) maintain(hostname string, peer *managedPeer) {
+	backoff := cm.MinBackoff
+	for {
+		if cm.srs.Connection(hostname) == nil {
+			cm.setState(hostname, peer, PeerConnecting)
+			ctx, cancel := context.WithTimeout(peer.ctx, cm.ConnectTimeout)
+			_, err := cm.srs.ConnectContext(ctx, peer.address)
+			cancel()
+
+			if err != nil {
+				if peer.ctx.Err() != nil {
+					return
+				}
+				if err == utils.BlockedError {
+					// Retrying can't help, stop maintaining the peer as
+					// BlockContact would have.
+					log.Printf("Not connecting to blocked peer %s", hostname)
+					cm.forget(hostname, peer)
+					cm.setState(hostname, peer, PeerDisconnected)
+					return
+				}
+				log.Printf("Could not connect to %s, retrying in %v: %v", hostname, backoff, err)
+				cm.setState(hostname, peer, PeerBackoff)
+				select {
+				case <-time.After(backoff):
+				case <-peer.wake:
+				case <-peer.ctx.Done():
+					return
+				}
+				backoff *= 2
+				if backoff > cm.MaxBackoff {
+					backoff = cm.MaxBackoff
+				}
+				continue
+			}
+		}
+
+		backoff = cm.MinBackoff
+		cm.setState(hostname, peer, PeerConnected)
+		if !cm.waitForDisconnect(hostname, peer) {
+			return
+		}
+		cm.setState(hostname, peer, PeerDisconnected)
+	}
+}
+
+// forget removes peer from the set the manager keeps connected to, unless it
+// has already been removed or replaced.
+func (cm *ConnectionManager) forget(hostname string, peer *managedPeer) {
+	cm.lock.Lock()
+	if cm.peers[hostname] == peer {
+		delete(cm.peers, hostname)
+	}
+	cm.lock.Unlock()
+	peer.cancel()
+}
+
+// waitForDisconnect blocks until the peer has no live connection, returning
+// false if the peer was removed from the manager first.
+func (cm *ConnectionManager) waitForDisconnect(hostname string, peer *managedPeer) bool {
+	for {
+		oc := cm.srs.Connection(hostname)
+		if oc == nil {
+			return peer.ctx.Err() == nil
+		}
+		select {
+		case <-oc.Done():
+		case <-peer.ctx.Done():
+			return false
+		}
+	}
+}
+
+// connectionAdded is called when any connection is authenticated, so that a
+// managed peer connecting to us ends its backoff early.
+func (cm *ConnectionManager) connectionAdded(oc *OpenConnection) {
+	cm.lock.Lock()
+	peer, exists := cm.peers[oc.OtherHostname()]
+	cm.lock.Unlock()
+	if exists {
+		select {
+		case peer.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// setState records and reports a change in the state of a peer.
+func (cm *ConnectionManager) setState(hostname string, peer *managedPeer, state PeerState) {
+	cm.lock.Lock()
+	changed := peer.state != state
+	peer.state = state
+	onStateChange := cm.OnStateChange
+	cm.lock.Unlock()
+
+	if changed && onStateChange != nil {
+		onStateChange(hostname, state)
+	}
+}
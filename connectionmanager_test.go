@@ -0,0 +1,178 @@
+package goricochet
+
+import "testing"
+import "time"
+import "crypto/rand"
+import "crypto/rsa"
+import "crypto/x509"
+import "encoding/pem"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+
+// writeTestKey generates a new RSA key and writes it to a PEM file in dir.
+func writeTestKey(t *testing.T, dir string, name string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	filename := filepath.Join(dir, name)
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(filename, pemData, 0600); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	return filename
+}
+
+// waitForState polls the manager until the peer reaches state.
+func waitForState(srs *StandardRicochetService, hostname string, state PeerState, timeout time.Duration) bool {
+	cm := srs.ConnectionManager()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cm.State(hostname) == state && (state != PeerConnected || srs.Connection(hostname) != nil) {
+			return true
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	return false
+}
+
+func TestConnectionManagerReconnect(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9900)
+
+	states := make(chan PeerState, 32)
+	cm := ricochetService.ConnectionManager()
+	cm.MinBackoff = time.Millisecond * 100
+	cm.MaxBackoff = time.Millisecond * 400
+	cm.ConnectTimeout = time.Second * 2
+	cm.OnStateChange = func(hostname string, state PeerState) {
+		states <- state
+	}
+	defer cm.Stop()
+
+	// The peer is not listening yet so the first attempts must fail
+	cm.AddPeer("127.0.0.1:9901|kwke2hntvyfqm7dr")
+	if !waitForState(ricochetService, "kwke2hntvyfqm7dr", PeerBackoff, time.Second*2) {
+		t.Fatalf("Expected peer to be in backoff, was %v", cm.State("kwke2hntvyfqm7dr"))
+	}
+
+	peerService := new(StandardRicochetService)
+	peerService.Init("./private_key")
+	go peerService.Listen(peerService, 9901)
+
+	if !waitForState(ricochetService, "kwke2hntvyfqm7dr", PeerConnected, time.Second*5) {
+		t.Fatalf("Expected peer to be connected, was %v", cm.State("kwke2hntvyfqm7dr"))
+	}
+
+	// Drop the connection, the manager should bring it back
+	dropped := ricochetService.Connection("kwke2hntvyfqm7dr")
+	dropped.Close()
+	time.Sleep(time.Millisecond * 100)
+	if !waitForState(ricochetService, "kwke2hntvyfqm7dr", PeerConnected, time.Second*5) {
+		t.Fatalf("Expected peer to reconnect, was %v", cm.State("kwke2hntvyfqm7dr"))
+	}
+	if ricochetService.Connection("kwke2hntvyfqm7dr") == dropped {
+		t.Errorf("Expected a new connection after reconnecting")
+	}
+
+	cm.RemovePeer("kwke2hntvyfqm7dr")
+	if cm.State("kwke2hntvyfqm7dr") != PeerDisconnected {
+		t.Errorf("Expected removed peer to be disconnected")
+	}
+
+	seen := make(map[PeerState]bool)
+	for len(states) > 0 {
+		seen[<-states] = true
+	}
+	for _, state := range []PeerState{PeerConnecting, PeerBackoff, PeerConnected, PeerDisconnected} {
+		if !seen[state] {
+			t.Errorf("Expected a state change to %v", state)
+		}
+	}
+}
+
+func TestConnectionManagerDeduplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "connectionmanager")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := new(StandardRicochetService)
+	if err := alice.Init(writeTestKey(t, dir, "alice")); err != nil {
+		t.Fatalf("Could not initate ricochet service: %v", err)
+	}
+	go alice.Listen(alice, 9902)
+
+	bob := new(StandardRicochetService)
+	if err := bob.Init(writeTestKey(t, dir, "bob")); err != nil {
+		t.Fatalf("Could not initate ricochet service: %v", err)
+	}
+	go bob.Listen(bob, 9903)
+
+	time.Sleep(time.Millisecond * 100)
+	alice.ConnectionManager().AddPeer("127.0.0.1:9903|" + bob.serverHostname)
+	bob.ConnectionManager().AddPeer("127.0.0.1:9902|" + alice.serverHostname)
+	defer alice.ConnectionManager().Stop()
+	defer bob.ConnectionManager().Stop()
+
+	if !waitForState(alice, bob.serverHostname, PeerConnected, time.Second*5) ||
+		!waitForState(bob, alice.serverHostname, PeerConnected, time.Second*5) {
+		t.Fatalf("Expected both peers to be connected")
+	}
+
+	// Let any duplicate connections settle
+	time.Sleep(time.Second)
+
+	aliceConn := alice.Connection(bob.serverHostname)
+	bobConn := bob.Connection(alice.serverHostname)
+	if aliceConn == nil || bobConn == nil {
+		t.Fatalf("Expected both peers to keep a connection")
+	}
+
+	// Both sides must have kept the connection initiated by the lower hostname
+	aliceInitiates := alice.serverHostname < bob.serverHostname
+	if aliceConn.Client != aliceInitiates || bobConn.Client == aliceInitiates {
+		t.Errorf("Peers kept the wrong connection: alice client %v, bob client %v", aliceConn.Client, bobConn.Client)
+	}
+}
+
+func TestConnectionManagerBlockedPeer(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.BlockContact("kwke2hntvyfqm7dr")
+
+	states := make(chan PeerState, 32)
+	cm := ricochetService.ConnectionManager()
+	cm.MinBackoff = time.Millisecond * 10
+	cm.OnStateChange = func(hostname string, state PeerState) {
+		states <- state
+	}
+	defer cm.Stop()
+
+	cm.AddPeer("127.0.0.1:9947|kwke2hntvyfqm7dr")
+	time.Sleep(time.Millisecond * 200)
+
+	cm.lock.Lock()
+	_, maintained := cm.peers["kwke2hntvyfqm7dr"]
+	cm.lock.Unlock()
+	if maintained {
+		t.Errorf("Expected the manager to stop maintaining a blocked peer")
+	}
+	for len(states) > 0 {
+		if state := <-states; state == PeerBackoff {
+			t.Errorf("Expected a blocked peer not to be retried")
+		}
+	}
+	if cm.State("kwke2hntvyfqm7dr") != PeerDisconnected {
+		t.Errorf("Expected a blocked peer to be disconnected, was %v", cm.State("kwke2hntvyfqm7dr"))
+	}
+}
@@ -0,0 +1,96 @@
+package goricochet
+
+import (
+	"github.com/s-rah/go-ricochet/utils"
+	"log"
+	"sync"
+)
+
+// connectionRegistry tracks the live, authenticated connections of a Ricochet
+// instance by the hostname of the peer, as normalised by setOtherHostname.
+type connectionRegistry struct {
+	lock        sync.Mutex
+	connections map[string]*OpenConnection
+
+	// added, if set, is called after a connection is registered.
+	added func(oc *OpenConnection)
+}
+
+// newConnectionRegistry creates an empty connectionRegistry.
+func newConnectionRegistry() *connectionRegistry {
+	cr := new(connectionRegistry)
+	cr.connections = make(map[string]*OpenConnection)
+	return cr
+}
+
+// add registers an authenticated connection. Only one connection is kept per
+// peer: if the peer already has a live connection in the same direction the
+// new one replaces it, as the old one is likely stale. If the connections are
+// in opposite directions (both sides connected at once) the one initiated by
+// the lower hostname is kept, so both peers make the same choice.
+// Returns false if oc was closed as a duplicate.
+func (cr *connectionRegistry) add(oc *OpenConnection) bool {
+	cr.lock.Lock()
+	existing, exists := cr.connections[oc.OtherHostname()]
+	if exists && !existing.IsClosed() && existing.Client != oc.Client {
+		keepNew := oc.Client == (oc.MyHostname() < oc.OtherHostname())
+		if !keepNew {
+			cr.lock.Unlock()
+			log.Printf("Closing duplicate connection to %s", oc.OtherHostname())
+			oc.Close()
+			return false
+		}
+	}
+	cr.connections[oc.OtherHostname()] = oc
+	added := cr.added
+	cr.lock.Unlock()
+
+	if exists && existing != oc {
+		log.Printf("Closing duplicate connection to %s", oc.OtherHostname())
+		existing.Close()
+	}
+	if added != nil {
+		added(oc)
+	}
+	return true
+}
+
+// remove unregisters oc, if it is still the connection for its peer.
+func (cr *connectionRegistry) remove(oc *OpenConnection) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.connections[oc.OtherHostname()] == oc {
+		delete(cr.connections, oc.OtherHostname())
+	}
+}
+
+// get returns the live connection to hostname, or nil.
+func (cr *connectionRegistry) get(hostname string) *OpenConnection {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	oc, exists := cr.connections[utils.ParseOnionHostname(hostname)]
+	if !exists || oc.IsClosed() {
+		return nil
+	}
+	return oc
+}
+
+// all returns a snapshot of the live connections.
+func (cr *connectionRegistry) all() []*OpenConnection {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	connections := make([]*OpenConnection, 0, len(cr.connections))
+	for _, oc := range cr.connections {
+		if !oc.IsClosed() {
+			connections = append(connections, oc)
+		}
+	}
+	return connections
+}
+
+// closeAll closes every registered connection.
+func (cr *connectionRegistry) closeAll() {
+	for _, oc := range cr.all() {
+		oc.Close()
+	}
+}
@@ -0,0 +1,76 @@
+package goricochet
+
+import "testing"
+import "time"
+import "context"
+import "strings"
+
+func TestConnectionRegistry(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9904)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(StandardRicochetService)
+	ricochetService2.Init("./private_key")
+	go ricochetService2.Listen(ricochetService2, 9905)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	oc, err := ricochetService2.ConnectContext(ctx, "127.0.0.1:9904|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+
+	if ricochetService2.Connection("ricochet:kwke2hntvyfqm7dr") != oc {
+		t.Errorf("Expected the connection to be registered by hostname")
+	}
+	if connections := ricochetService2.Connections(); len(connections) != 1 || connections[0] != oc {
+		t.Errorf("Expected exactly one live connection, got %v", connections)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	inbound := ricochetService.Connection("kwke2hntvyfqm7dr")
+	if inbound == nil || inbound.Client {
+		t.Errorf("Expected the server to register the authenticated inbound connection")
+	}
+
+	ricochetService2.CloseAll()
+	if !oc.IsClosed() {
+		t.Errorf("Expected CloseAll to close the connection")
+	}
+	if ricochetService2.Connection("kwke2hntvyfqm7dr") != nil || len(ricochetService2.Connections()) != 0 {
+		t.Errorf("Expected no live connections after CloseAll")
+	}
+}
+
+func TestConnectionRegistryNormalisesHostnames(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	if err := ricochetService.Init("./private_key"); err != nil {
+		t.Fatalf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9941)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(StandardRicochetService)
+	ricochetService2.Init("./private_key")
+	go ricochetService2.Listen(ricochetService2, 9942)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	oc, err := ricochetService2.ConnectContext(ctx, "127.0.0.1:9941|"+strings.ToUpper("kwke2hntvyfqm7dr"))
+	if err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+	if oc.OtherHostname() != "kwke2hntvyfqm7dr" || oc.DialledHostname() != "kwke2hntvyfqm7dr" {
+		t.Errorf("Expected the dialled hostname to be normalised, got %v", oc.OtherHostname())
+	}
+	if ricochetService2.Connection("kwke2hntvyfqm7dr") != oc || ricochetService2.Connection("ricochet:KWKE2HNTVYFQM7DR") != oc {
+		t.Errorf("Expected the connection to be found by any form of its hostname")
+	}
+}
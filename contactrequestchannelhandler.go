@@ -0,0 +1,87 @@
+package goricochet
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/s-rah/go-ricochet/contact"
+	"github.com/s-rah/go-ricochet/control"
+)
+
+// ContactRequestChannelHandler is the ChannelHandler for
+// im.ricochet.contact.request channels.
+type ContactRequestChannelHandler struct {
+}
+
+// OnOpenChannelRequest validates an inbound contact request and passes the nick
+// and message on to the service.
+func (crch *ContactRequestChannelHandler) OnOpenChannelRequest(oc *OpenConnection, service RicochetService, opm *Protocol_Data_Control.OpenChannel) {
+	if oc.Client {
+		// Servers are not allowed to send contact requests
+		service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+	} else if !oc.IsAuthed() {
+		// Can't open a contact channel if not authed
+		service.OnUnauthorizedError(oc, opm.GetChannelIdentifier())
+	} else if oc.HasChannel("im.ricochet.contact.request") {
+		// Only 1 contact channel is allowed to be open at a time
+		service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+	} else {
+		contactRequestI, err := proto.GetExtension(opm, Protocol_Data_ContactRequest.E_ContactRequest)
+		if err == nil {
+			contactRequest, check := contactRequestI.(*Protocol_Data_ContactRequest.ContactRequest)
+			if check {
+				err := checkNicknameLength(contactRequest.GetNickname())
+				if err == nil {
+					err = checkMessageLength(contactRequest.GetMessageText())
+				}
+				if err != nil {
+					service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+					service.OnLimitExceeded(oc, opm.GetChannelIdentifier(), err)
+					return
+				}
+				service.OnContactRequest(oc, opm.GetChannelIdentifier(), contactRequest.GetNickname(), contactRequest.GetMessageText())
+				return
+			}
+		}
+		service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+	}
+}
+
+// OnOpenChannelResult passes the initial response to a contact request on to
+// the service.
+func (crch *ContactRequestChannelHandler) OnOpenChannelResult(oc *OpenConnection, service RicochetService, crm *Protocol_Data_Control.ChannelResult) {
+	responseI, err := proto.GetExtension(crm, Protocol_Data_ContactRequest.E_Response)
+	if err == nil {
+		response, check := responseI.(*Protocol_Data_ContactRequest.Response)
+		if check {
+			service.OnContactRequestAck(oc, crm.GetChannelIdentifier(), response.GetStatus().String())
+			return
+		}
+	}
+	service.OnBadUsageError(oc, crm.GetChannelIdentifier())
+}
+
+// OnPacket handles subsequent responses to a pending contact request.
+func (crch *ContactRequestChannelHandler) OnPacket(oc *OpenConnection, service RicochetService, channelID int32, data []byte) {
+	// NOTE: These auth checks should be redundant, however they
+	// are included here for defense-in-depth if for some reason
+	// a previously authed connection becomes untrusted / not known and
+	// the state is not cleaned up.
+	if !oc.Client {
+		// Clients are not allowed to send contact request responses
+		service.OnBadUsageError(oc, channelID)
+	} else if !oc.IsAuthed() {
+		// Can't send a contact request if not authed
+		service.OnBadUsageError(oc, channelID)
+	} else {
+		res := new(Protocol_Data_ContactRequest.Response)
+		err := proto.Unmarshal(data[:], res)
+		if err != nil {
+			oc.CloseChannel(channelID)
+			return
+		}
+		service.OnContactRequestAck(oc, channelID, res.GetStatus().String())
+	}
+}
+
+// OnChannelClosed is a NoOp for contact request channels.
+func (crch *ContactRequestChannelHandler) OnChannelClosed(oc *OpenConnection, service RicochetService, channelID int32) {
+}
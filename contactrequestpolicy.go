@@ -0,0 +1,106 @@
+package goricochet
+
+import (
+	"github.com/s-rah/go-ricochet/utils"
+	"sync"
+	"time"
+)
+
+// ContactRequestPolicy decides how a StandardRicochetService responds to
+// inbound contact requests. Decide returns ContactAccepted or ContactRejected
+// to answer the request straight away, or ContactPending to leave it for the
+// application to answer later with ApproveContact or RejectContact.
+type ContactRequestPolicy interface {
+	Decide(hostname string, nickname string, message string) ContactStatus
+}
+
+// ContactRequestPolicyFunc adapts an ordinary function to a
+// ContactRequestPolicy.
+type ContactRequestPolicyFunc func(hostname string, nickname string, message string) ContactStatus
+
+// Decide calls f(hostname, nickname, message).
+func (f ContactRequestPolicyFunc) Decide(hostname string, nickname string, message string) ContactStatus {
+	return f(hostname, nickname, message)
+}
+
+// Built in policies.
+var (
+	// AcceptAllContactRequests accepts every contact request.
+	AcceptAllContactRequests = ContactRequestPolicyFunc(func(string, string, string) ContactStatus {
+		return ContactAccepted
+	})
+
+	// RejectAllContactRequests rejects every contact request.
+	RejectAllContactRequests = ContactRequestPolicyFunc(func(string, string, string) ContactStatus {
+		return ContactRejected
+	})
+
+	// ReviewContactRequests leaves every contact request pending for the
+	// application to review. It is the default policy.
+	ReviewContactRequests = ContactRequestPolicyFunc(func(string, string, string) ContactStatus {
+		return ContactPending
+	})
+)
+
+// AllowlistPolicy accepts contact requests from a fixed set of hostnames, and
+// passes all others to Otherwise.
+type AllowlistPolicy struct {
+	Hostnames map[string]bool
+	Otherwise ContactRequestPolicy
+}
+
+// NewAllowlistPolicy creates an AllowlistPolicy accepting requests from the
+// given hostnames, in any form accepted by Connect.
+func NewAllowlistPolicy(otherwise ContactRequestPolicy, hostnames ...string) *AllowlistPolicy {
+	ap := &AllowlistPolicy{Hostnames: make(map[string]bool), Otherwise: otherwise}
+	for _, hostname := range hostnames {
+		ap.Hostnames[utils.ParseOnionHostname(hostname)] = true
+	}
+	return ap
+}
+
+// Decide accepts the request if hostname is allowed.
+func (ap *AllowlistPolicy) Decide(hostname string, nickname string, message string) ContactStatus {
+	if ap.Hostnames[hostname] {
+		return ContactAccepted
+	}
+	return ap.Otherwise.Decide(hostname, nickname, message)
+}
+
+// RateLimitedPolicy accepts at most Limit contact requests in any Interval,
+// and passes requests beyond that to Otherwise.
+type RateLimitedPolicy struct {
+	Limit     int
+	Interval  time.Duration
+	Otherwise ContactRequestPolicy
+
+	lock     sync.Mutex
+	accepted []time.Time
+}
+
+// NewRateLimitedPolicy creates a RateLimitedPolicy.
+func NewRateLimitedPolicy(limit int, interval time.Duration, otherwise ContactRequestPolicy) *RateLimitedPolicy {
+	return &RateLimitedPolicy{Limit: limit, Interval: interval, Otherwise: otherwise}
+}
+
+// Decide accepts the request unless Limit requests have already been accepted
+// in the last Interval.
+func (rlp *RateLimitedPolicy) Decide(hostname string, nickname string, message string) ContactStatus {
+	rlp.lock.Lock()
+	now := time.Now()
+	recent := rlp.accepted[:0]
+	for _, accepted := range rlp.accepted {
+		if now.Sub(accepted) < rlp.Interval {
+			recent = append(recent, accepted)
+		}
+	}
+	rlp.accepted = recent
+
+	if len(rlp.accepted) < rlp.Limit {
+		rlp.accepted = append(rlp.accepted, now)
+		rlp.lock.Unlock()
+		return ContactAccepted
+	}
+	rlp.lock.Unlock()
+	return rlp.Otherwise.Decide(hostname, nickname, message)
+}
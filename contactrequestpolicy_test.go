@@ -0,0 +1,128 @@
+package goricochet
+
+import "testing"
+import "time"
+
+func TestAllowlistPolicy(t *testing.T) {
+	policy := NewAllowlistPolicy(RejectAllContactRequests, "ricochet:kwke2hntvyfqm7dr")
+	if policy.Decide("kwke2hntvyfqm7dr", "nick", "message") != ContactAccepted {
+		t.Errorf("Expected allowed hostname to be accepted")
+	}
+	if policy.Decide("jlq67qzo6s4yp3sp", "nick", "message") != ContactRejected {
+		t.Errorf("Expected other hostnames to be passed to the fallback policy")
+	}
+}
+
+func TestRateLimitedPolicy(t *testing.T) {
+	policy := NewRateLimitedPolicy(2, time.Millisecond*200, ReviewContactRequests)
+	for i := 0; i < 2; i++ {
+		if policy.Decide("kwke2hntvyfqm7dr", "nick", "message") != ContactAccepted {
+			t.Errorf("Expected request %v to be accepted", i)
+		}
+	}
+	if policy.Decide("kwke2hntvyfqm7dr", "nick", "message") != ContactPending {
+		t.Errorf("Expected requests over the limit to be passed to the fallback policy")
+	}
+	time.Sleep(time.Millisecond * 250)
+	if policy.Decide("kwke2hntvyfqm7dr", "nick", "message") != ContactAccepted {
+		t.Errorf("Expected requests to be accepted again after the interval")
+	}
+}
+
+type ContactPolicyTestService struct {
+	StandardRicochetService
+	replies chan string
+}
+
+func (cpts *ContactPolicyTestService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
+	cpts.StandardRicochetService.OnAuthenticationResult(oc, channelID, result, isKnownContact)
+	oc.SendContactRequest(3, "alice", "hi")
+}
+
+func (cpts *ContactPolicyTestService) OnContactRequestAck(oc *OpenConnection, channelID int32, status string) {
+	cpts.StandardRicochetService.OnContactRequestAck(oc, channelID, status)
+	cpts.replies <- status
+}
+
+func TestContactRequestPolicyReject(t *testing.T) {
+	ricochetService := new(ContactPolicyTestService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.SetContactRequestPolicy(RejectAllContactRequests)
+	go ricochetService.Listen(ricochetService, 9920)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(ContactPolicyTestService)
+	ricochetService2.Init("./private_key")
+	ricochetService2.replies = make(chan string, 1)
+	go ricochetService2.Listen(ricochetService2, 9921)
+
+	_, err = ricochetService2.Connect("127.0.0.1:9920|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect to ricochet service: %v", err)
+	}
+
+	select {
+	case status := <-ricochetService2.replies:
+		if status != "Rejected" {
+			t.Errorf("Expected the contact request to be rejected, got %v", status)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for contact request reply")
+	}
+
+	if contact, _ := ricochetService.ContactStore().GetContact("kwke2hntvyfqm7dr"); contact.Status != ContactRejected {
+		t.Errorf("Expected the rejection to be recorded, got %v", contact)
+	}
+	if ricochetService2.IsKnownContact("kwke2hntvyfqm7dr") {
+		t.Errorf("Expected a rejected contact request not to make a known contact")
+	}
+}
+
+func TestPendingContactRequestClearedOnDisconnect(t *testing.T) {
+	ricochetService := new(ContactPolicyTestService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9945)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(ContactPolicyTestService)
+	ricochetService2.Init("./private_key")
+	ricochetService2.replies = make(chan string, 1)
+	go ricochetService2.Listen(ricochetService2, 9946)
+
+	oc, err := ricochetService2.Connect("127.0.0.1:9945|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+
+	select {
+	case status := <-ricochetService2.replies:
+		if status != "Pending" {
+			t.Fatalf("Expected the contact request to be pending, got %v", status)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for contact request reply")
+	}
+
+	oc.Close()
+	pending := func() bool {
+		ricochetService.lock.Lock()
+		defer ricochetService.lock.Unlock()
+		_, exists := ricochetService.pendingRequests["kwke2hntvyfqm7dr"]
+		return exists
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for pending() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if pending() {
+		t.Errorf("Expected the pending request to be forgotten when its connection closed")
+	}
+}
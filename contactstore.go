@@ -0,0 +1,129 @@
+package goricochet
+
+import (
+	"github.com/s-rah/go-ricochet/utils"
+	"sort"
+	"sync"
+)
+
+// ContactStatus is the status of the contact request between us and a
+// contact.
+type ContactStatus int
+
+const (
+	// ContactPending means a contact request has been sent or received but
+	// not yet answered.
+	ContactPending ContactStatus = iota
+	// ContactAccepted means the contact request was accepted, or the contact
+	// was added directly.
+	ContactAccepted
+	// ContactRejected means the contact request was rejected.
+	ContactRejected
+)
+
+var contactStatusNames = map[ContactStatus]string{
+	ContactPending:  "Pending",
+	ContactAccepted: "Accepted",
+	ContactRejected: "Rejected",
+}
+
+func (cs ContactStatus) String() string {
+	if name, ok := contactStatusNames[cs]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// MarshalText encodes the status by name.
+func (cs ContactStatus) MarshalText() ([]byte, error) {
+	return []byte(cs.String()), nil
+}
+
+// UnmarshalText decodes a status encoded with MarshalText.
+func (cs *ContactStatus) UnmarshalText(text []byte) error {
+	for status, name := range contactStatusNames {
+		if name == string(text) {
+			*cs = status
+			return nil
+		}
+	}
+	return utils.UnknownContactStatusError
+}
+
+// Contact is a peer we know about.
+type Contact struct {
+	Hostname string        `json:"hostname"`
+	Nickname string        `json:"nickname"`
+	Status   ContactStatus `json:"status"`
+	Blocked  bool          `json:"blocked"`
+
+	// Message is the message sent with the peer's contact request, if any.
+	Message string `json:"message,omitempty"`
+}
+
+// ContactStore stores the contacts of a service. Implementations must be safe
+// to call from multiple goroutines.
+type ContactStore interface {
+	// GetContact returns the contact with the given onion hostname, if any.
+	GetContact(hostname string) (Contact, bool)
+	// Contacts returns every contact.
+	Contacts() []Contact
+	// SaveContact adds the contact, or replaces the contact with the same
+	// hostname.
+	SaveContact(contact Contact) error
+	// RemoveContact removes the contact with the given hostname, if any.
+	RemoveContact(hostname string) error
+}
+
+// MemoryContactStore is a ContactStore which does not persist contacts. It is
+// the default store of a StandardRicochetService.
+type MemoryContactStore struct {
+	lock     sync.Mutex
+	contacts map[string]Contact
+}
+
+// NewMemoryContactStore creates an empty MemoryContactStore.
+func NewMemoryContactStore() *MemoryContactStore {
+	mcs := new(MemoryContactStore)
+	mcs.contacts = make(map[string]Contact)
+	return mcs
+}
+
+// GetContact returns the contact with the given onion hostname, if any.
+func (mcs *MemoryContactStore) GetContact(hostname string) (Contact, bool) {
+	mcs.lock.Lock()
+	defer mcs.lock.Unlock()
+	contact, exists := mcs.contacts[utils.ParseOnionHostname(hostname)]
+	return contact, exists
+}
+
+// Contacts returns every contact.
+func (mcs *MemoryContactStore) Contacts() []Contact {
+	mcs.lock.Lock()
+	defer mcs.lock.Unlock()
+	contacts := make([]Contact, 0, len(mcs.contacts))
+	for _, contact := range mcs.contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].Hostname < contacts[j].Hostname
+	})
+	return contacts
+}
+
+// SaveContact adds the contact, or replaces the contact with the same hostname.
+func (mcs *MemoryContactStore) SaveContact(contact Contact) error {
+	mcs.lock.Lock()
+	defer mcs.lock.Unlock()
+	contact.Hostname = utils.ParseOnionHostname(contact.Hostname)
+	mcs.contacts[contact.Hostname] = contact
+	return nil
+}
+
+// RemoveContact removes the contact with the given hostname, if any.
+func (mcs *MemoryContactStore) RemoveContact(hostname string) error {
+	mcs.lock.Lock()
+	defer mcs.lock.Unlock()
+	delete(mcs.contacts, utils.ParseOnionHostname(hostname))
+	return nil
+}
@@ -0,0 +1,129 @@
+package goricochet
+
+import "testing"
+import "time"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+
+func TestFileContactStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contactstore")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "contacts.json")
+
+	store, err := NewFileContactStore(filename)
+	if err != nil {
+		t.Fatalf("Could not create contact store: %v", err)
+	}
+	store.SaveContact(Contact{Hostname: "ricochet:kwke2hntvyfqm7dr", Nickname: "kwke", Status: ContactAccepted})
+	store.SaveContact(Contact{Hostname: "jlq67qzo6s4yp3sp", Nickname: "jlq", Status: ContactPending, Message: "hello"})
+	store.SaveContact(Contact{Hostname: "qn6uo4cmsrfv4kzq", Status: ContactRejected, Blocked: true})
+	store.RemoveContact("qn6uo4cmsrfv4kzq")
+
+	data, _ := ioutil.ReadFile(filename)
+	if !strings.Contains(string(data), `"status": "Pending"`) {
+		t.Errorf("Expected statuses to be saved by name: %s", data)
+	}
+
+	reloaded, err := NewFileContactStore(filename)
+	if err != nil {
+		t.Fatalf("Could not reload contact store: %v", err)
+	}
+	contacts := reloaded.Contacts()
+	if len(contacts) != 2 {
+		t.Fatalf("Expected 2 contacts after reloading, got %v", contacts)
+	}
+	contact, exists := reloaded.GetContact("kwke2hntvyfqm7dr")
+	if !exists || contact.Nickname != "kwke" || contact.Status != ContactAccepted {
+		t.Errorf("Unexpected contact after reloading: %v", contact)
+	}
+	contact, exists = reloaded.GetContact("jlq67qzo6s4yp3sp")
+	if !exists || contact.Message != "hello" || contact.Status != ContactPending {
+		t.Errorf("Unexpected contact after reloading: %v", contact)
+	}
+	if _, exists := reloaded.GetContact("qn6uo4cmsrfv4kzq"); exists {
+		t.Errorf("Expected removed contact not to be reloaded")
+	}
+}
+
+func TestFileContactStoreInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contactstore")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "contacts.json")
+
+	ioutil.WriteFile(filename, []byte(`[{"hostname": "kwke2hntvyfqm7dr", "status": "Friendly"}]`), 0600)
+	if _, err := NewFileContactStore(filename); err == nil {
+		t.Errorf("Expected an unknown status to fail to load")
+	}
+}
+
+type ContactStoreTestService struct {
+	StandardRicochetService
+}
+
+func (csts *ContactStoreTestService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
+	csts.StandardRicochetService.OnAuthenticationResult(oc, channelID, result, isKnownContact)
+	oc.SendContactRequest(3, "alice", "hi")
+}
+
+func TestContactStoreContactRequest(t *testing.T) {
+	ricochetService := new(ContactStoreTestService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9918)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(ContactStoreTestService)
+	ricochetService2.Init("./private_key")
+	go ricochetService2.Listen(ricochetService2, 9919)
+
+	if ricochetService2.IsKnownContact("kwke2hntvyfqm7dr") {
+		t.Errorf("Expected no known contacts before the contact request")
+	}
+
+	_, err = ricochetService2.Connect("127.0.0.1:9918|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect to ricochet service: %v", err)
+	}
+
+	time.Sleep(time.Second)
+
+	contact, exists := ricochetService.ContactStore().GetContact("kwke2hntvyfqm7dr")
+	if !exists || contact.Status != ContactPending || contact.Nickname != "alice" || contact.Message != "hi" {
+		t.Errorf("Expected the contact request to be recorded as pending, got %v", contact)
+	}
+	if contact, _ := ricochetService2.ContactStore().GetContact("kwke2hntvyfqm7dr"); contact.Status != ContactPending {
+		t.Errorf("Expected the pending reply to be recorded, got %v", contact)
+	}
+	if pending := ricochetService.PendingContactRequests(); len(pending) != 1 {
+		t.Errorf("Expected one pending contact request, got %v", pending)
+	}
+
+	ricochetService.ApproveContact("kwke2hntvyfqm7dr")
+	time.Sleep(time.Millisecond * 500)
+	if !ricochetService.IsKnownContact("kwke2hntvyfqm7dr") {
+		t.Errorf("Expected ApproveContact to make a known contact")
+	}
+	if !ricochetService2.IsKnownContact("kwke2hntvyfqm7dr") {
+		t.Errorf("Expected the approved contact request to make a known contact")
+	}
+
+	ricochetService.AddContact("kwke2hntvyfqm7dr", "")
+	if contact, _ := ricochetService.ContactStore().GetContact("kwke2hntvyfqm7dr"); contact.Nickname != "alice" {
+		t.Errorf("Expected AddContact to keep the existing nickname, got %v", contact.Nickname)
+	}
+	ricochetService.RemoveContact("kwke2hntvyfqm7dr")
+	if ricochetService.IsKnownContact("kwke2hntvyfqm7dr") {
+		t.Errorf("Expected RemoveContact to remove the contact")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/s-rah/go-ricochet"
 	"log"
+	"time"
 )
 
 // EchoBotService is an example service which simply echoes back what a client
@@ -16,17 +17,10 @@ func (ebs *EchoBotService) IsKnownContact(hostname string) bool {
 	return true
 }
 
-// OnContactRequest - we always accept new contact request.
-func (ebs *EchoBotService) OnContactRequest(oc *goricochet.OpenConnection, channelID int32, nick string, message string) {
-	ts.StandardRicochetService.OnContactRequest(oc, channelID, nick, message)
-	oc.AckContactRequestOnResponse(channelID, "Accepted")
-	oc.CloseChannel(channelID)
-}
-
 // OnChatMessage we acknowledge the message, grab the message content and send it back - opening
 // a new channel if necessary.
-func (ebs *EchoBotService) OnChatMessage(oc *goricochet.OpenConnection, channelID int32, messageID int32, message string) {
-	log.Printf("Received Message from %s: %s", oc.OtherHostname, message)
+func (ebs *EchoBotService) OnChatMessage(oc *goricochet.OpenConnection, channelID int32, messageID int32, message string, written time.Time) {
+	log.Printf("Received Message from %s: %s", oc.OtherHostname(), message)
 	oc.AckChatMessage(channelID, messageID)
 	if oc.GetChannelType(6) == "none" {
 		oc.OpenChatChannel(6)
@@ -36,6 +30,14 @@ func (ebs *EchoBotService) OnChatMessage(oc *goricochet.OpenConnection, channelI
 
 func main() {
 	ricochetService := new(EchoBotService)
-	ricochetService.Init("./private_key")
-	ricochetService.Listen(ricochetService, 12345)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		log.Fatalf("Could not start echobot: %v", err)
+	}
+	// We always accept new contact requests
+	ricochetService.SetContactRequestPolicy(goricochet.AcceptAllContactRequests)
+	err = ricochetService.Listen(ricochetService, 12345)
+	if err != nil {
+		log.Fatalf("Could not start echobot: %v", err)
+	}
 }
@@ -0,0 +1,65 @@
+package goricochet
+
+import "testing"
+import "time"
+
+// featuresEnabled is what a TestFeaturesService saw when features were enabled.
+type featuresEnabled struct {
+	Enabled []string
+	HasA    bool
+	HasC    bool
+}
+
+type TestFeaturesService struct {
+	StandardRicochetService
+	// FeaturesEnabled, if set, is sent the features enabled on a connection.
+	FeaturesEnabled chan featuresEnabled
+}
+
+func (ts *TestFeaturesService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
+	ts.StandardRicochetService.OnAuthenticationResult(oc, channelID, result, isKnownContact)
+	oc.EnableFeatures([]string{"im.ricochet.test-a", "im.ricochet.test-c"})
+}
+
+func (ts *TestFeaturesService) OnFeaturesEnabled(oc *OpenConnection, features []string) {
+	ts.StandardRicochetService.OnFeaturesEnabled(oc, features)
+	select {
+	case ts.FeaturesEnabled <- featuresEnabled{features, oc.HasFeature("im.ricochet.test-a"), oc.HasFeature("im.ricochet.test-c")}:
+	default:
+	}
+}
+
+func TestFeatureNegotiation(t *testing.T) {
+	ricochetService := new(TestFeaturesService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.AdvertiseFeatures("im.ricochet.test-a", "im.ricochet.test-b")
+
+	go ricochetService.Listen(ricochetService, 9891)
+
+	time.Sleep(time.Second * 2)
+
+	ricochetService2 := new(TestFeaturesService)
+	err = ricochetService2.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService2.FeaturesEnabled = make(chan featuresEnabled, 1)
+
+	go ricochetService2.Listen(ricochetService2, 9892)
+	_, err = ricochetService2.Connect("127.0.0.1:9891|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect to ricochet service:  %v", err)
+	}
+
+	select {
+	case fe := <-ricochetService2.FeaturesEnabled:
+		if len(fe.Enabled) != 1 || fe.Enabled[0] != "im.ricochet.test-a" || !fe.HasA || fe.HasC {
+			t.Errorf("Unexpected features enabled %v (test-a: %v, test-c: %v)", fe.Enabled, fe.HasA, fe.HasC)
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("Features were not enabled")
+	}
+}
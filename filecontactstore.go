@@ -0,0 +1,96 @@
+package goricochet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileContactStore is a ContactStore which persists contacts to a JSON file.
+// The file is rewritten after every change.
+type FileContactStore struct {
+	filename string
+
+	// writeLock serializes writes to the file.
+	writeLock sync.Mutex
+	memory    *MemoryContactStore
+}
+
+// NewFileContactStore creates a FileContactStore backed by filename, loading
+// any contacts already saved there. The file is created on the first change
+// if it does not exist.
+func NewFileContactStore(filename string) (*FileContactStore, error) {
+	fcs := new(FileContactStore)
+	fcs.filename = filename
+	fcs.memory = NewMemoryContactStore()
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return fcs, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var contacts []Contact
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, err
+	}
+	for _, contact := range contacts {
+		fcs.memory.SaveContact(contact)
+	}
+	return fcs, nil
+}
+
+// GetContact returns the contact with the given onion hostname, if any.
+func (fcs *FileContactStore) GetContact(hostname string) (Contact, bool) {
+	return fcs.memory.GetContact(hostname)
+}
+
+// Contacts returns every contact.
+func (fcs *FileContactStore) Contacts() []Contact {
+	return fcs.memory.Contacts()
+}
+
+// SaveContact adds the contact, or replaces the contact with the same
+// hostname, and saves the file.
+func (fcs *FileContactStore) SaveContact(contact Contact) error {
+	fcs.writeLock.Lock()
+	defer fcs.writeLock.Unlock()
+	fcs.memory.SaveContact(contact)
+	return fcs.save()
+}
+
+// RemoveContact removes the contact with the given hostname, if any, and saves
+// the file.
+func (fcs *FileContactStore) RemoveContact(hostname string) error {
+	fcs.writeLock.Lock()
+	defer fcs.writeLock.Unlock()
+	fcs.memory.RemoveContact(hostname)
+	return fcs.save()
+}
+
+// save atomically replaces the file with the current contacts. Must be called
+// with writeLock held.
+func (fcs *FileContactStore) save() error {
+	data, err := json.MarshalIndent(fcs.memory.Contacts(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fcs.filename), filepath.Base(fcs.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fcs.filename)
+}
@@ -0,0 +1,146 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/s-rah/go-ricochet/utils"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// encryptedKeyType is the PEM type of passphrase protected identities.
+	encryptedKeyType = "RICOCHET ENCRYPTED PRIVATE KEY"
+
+	// The scrypt parameters used to derive the key which encrypts an
+	// identity from its passphrase.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	// The largest scrypt parameters a key file can ask for. scrypt needs
+	// 128*N*r bytes of memory, which maxScryptMemory bounds to 1 GiB, and
+	// does that work p times.
+	maxScryptN      = 1 << 20
+	maxScryptR      = 16
+	maxScryptP      = 4
+	maxScryptMemory = 1 << 30
+
+	saltSize = 16
+)
+
+// MarshalEncryptedPEM encodes the private key of the identity as PEM,
+// encrypted with AES-256-GCM under a key derived from passphrase by scrypt.
+// The KDF parameters, salt and nonce are stored as PEM headers.
+func (id *Identity) MarshalEncryptedPEM(passphrase []byte) ([]byte, error) {
+	plaintext, err := id.MarshalPEM()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	block := &pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"KDF":    fmt.Sprintf("scrypt,N=%d,r=%d,p=%d", scryptN, scryptR, scryptP),
+			"Salt":   hex.EncodeToString(salt),
+			"Cipher": "AES-256-GCM",
+		},
+	}
+
+	aead, err := newKeyAEAD(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	block.Headers["Nonce"] = hex.EncodeToString(nonce)
+	block.Bytes = aead.Seal(nil, nonce, plaintext, additionalData(block))
+	return pem.EncodeToMemory(block), nil
+}
+
+// SaveEncrypted is like Save, but protects the key with passphrase, see
+// MarshalEncryptedPEM.
+func (id *Identity) SaveEncrypted(filename string, passphrase []byte) error {
+	pemData, err := id.MarshalEncryptedPEM(passphrase)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(filename, pemData)
+}
+
+// ParseEncryptedPEM decrypts an identity encoded by MarshalEncryptedPEM.
+// Returns utils.IncorrectPassphraseError if passphrase does not decrypt it.
+func ParseEncryptedPEM(pemData []byte, passphrase []byte) (*Identity, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil || block.Type != encryptedKeyType || block.Headers["Cipher"] != "AES-256-GCM" {
+		return nil, utils.InvalidPrivateKeyError
+	}
+
+	var n, r, p int
+	if _, err := fmt.Sscanf(block.Headers["KDF"], "scrypt,N=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return nil, utils.InvalidPrivateKeyError
+	}
+	if n <= 1 || n > maxScryptN || r <= 0 || r > maxScryptR || p <= 0 || p > maxScryptP || 128*n*r > maxScryptMemory {
+		return nil, utils.InvalidPrivateKeyError
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, utils.InvalidPrivateKeyError
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, utils.InvalidPrivateKeyError
+	}
+
+	aead, err := newKeyAEAD(passphrase, salt, n, r, p)
+	if err != nil {
+		return nil, utils.InvalidPrivateKeyError
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, utils.InvalidPrivateKeyError
+	}
+	plaintext, err := aead.Open(nil, nonce, block.Bytes, additionalData(block))
+	if err != nil {
+		return nil, utils.IncorrectPassphraseError
+	}
+	return ParsePEM(plaintext)
+}
+
+// LoadEncryptedFile reads an identity saved by SaveEncrypted.
+func LoadEncryptedFile(filename string, passphrase []byte) (*Identity, error) {
+	pemData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEncryptedPEM(pemData, passphrase)
+}
+
+// newKeyAEAD derives the key which encrypts an identity from passphrase.
+func newKeyAEAD(passphrase []byte, salt []byte, n int, r int, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the KDF parameters and cipher of an encrypted key to
+// its ciphertext, so they cannot be altered without detection.
+func additionalData(block *pem.Block) []byte {
+	return []byte(block.Type + "\n" + block.Headers["KDF"] + "\n" + block.Headers["Salt"] + "\n" + block.Headers["Cipher"])
+}
@@ -0,0 +1,95 @@
+package identity
+
+import (
+	"crypto"
+	"github.com/s-rah/go-ricochet/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id, _ := Generate(V3)
+	filename := filepath.Join(dir, "private_key")
+	if err := id.SaveEncrypted(filename, []byte("correct horse")); err != nil {
+		t.Fatalf("Could not save encrypted identity: %v", err)
+	}
+
+	pemData, _ := ioutil.ReadFile(filename)
+	if strings.Contains(string(pemData), "BEGIN PRIVATE KEY") {
+		t.Errorf("Expected the saved key to be encrypted")
+	}
+	if _, err := LoadFile(filename); err != utils.PassphraseRequiredError {
+		t.Errorf("Expected PassphraseRequiredError loading without a passphrase, got %v", err)
+	}
+	if _, err := LoadEncryptedFile(filename, []byte("battery staple")); err != utils.IncorrectPassphraseError {
+		t.Errorf("Expected IncorrectPassphraseError, got %v", err)
+	}
+
+	loaded, err := LoadEncryptedFile(filename, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Could not load encrypted identity: %v", err)
+	}
+	if loaded.Hostname() != id.Hostname() {
+		t.Errorf("Loaded identity %v does not match %v", loaded.Hostname(), id.Hostname())
+	}
+
+	// The KDF parameters are authenticated
+	tampered := strings.Replace(string(pemData), "r=8", "r=9", 1)
+	if _, err := ParseEncryptedPEM([]byte(tampered), []byte("correct horse")); err != utils.IncorrectPassphraseError {
+		t.Errorf("Expected modified KDF parameters to be detected, got %v", err)
+	}
+
+	// Parameters which would take too much memory or work are refused
+	// before scrypt is run
+	for _, kdf := range []string{"N=1048576,r=16,p=1", "N=32768,r=8388607,p=1", "N=32768,r=1,p=8388607", "N=32768,r=8,p=5"} {
+		tampered := strings.Replace(string(pemData), "N=32768,r=8,p=1", kdf, 1)
+		if _, err := ParseEncryptedPEM([]byte(tampered), []byte("correct horse")); err != utils.InvalidPrivateKeyError {
+			t.Errorf("Expected KDF parameters %v to be refused, got %v", kdf, err)
+		}
+	}
+}
+
+// agentSigner stands in for a key held by another process.
+type agentSigner struct {
+	key    crypto.Signer
+	signed int
+}
+
+func (as *agentSigner) Public() crypto.PublicKey {
+	return as.key.Public()
+}
+
+func (as *agentSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	as.signed++
+	return as.key.Sign(rand, digest, opts)
+}
+
+func TestNewFromSigner(t *testing.T) {
+	for _, version := range []Version{V2, V3} {
+		key, _ := Generate(version)
+		signer := &agentSigner{key: key.PrivateKey().(crypto.Signer)}
+		id, err := NewFromSigner(signer)
+		if err != nil {
+			t.Fatalf("Could not create identity from signer: %v", err)
+		}
+		if id.Version() != version || id.Hostname() != key.Hostname() {
+			t.Errorf("Unexpected identity %v %v", id.Version(), id.Hostname())
+		}
+
+		challenge := []byte("0123456789abcdef0123456789abcdef")
+		signature, err := id.Sign(challenge)
+		if err != nil || signer.signed != 1 || !id.Verify(challenge, signature) {
+			t.Errorf("Expected the challenge to be signed by the signer: %v", err)
+		}
+	}
+}
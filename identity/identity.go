@@ -0,0 +1,159 @@
+// Package identity provides the keys which identify ricochet services: the
+// RSA-1024 keys of legacy (version 2) onion services and the Ed25519 keys of
+// version 3 onion services.
+package identity
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"github.com/s-rah/go-ricochet/utils"
+)
+
+// Version is the version of the onion service an identity belongs to.
+type Version int
+
+const (
+	// V2 identities are RSA-1024 keys with 16 character onion hostnames.
+	V2 Version = 2
+
+	// V3 identities are Ed25519 keys with 56 character onion hostnames.
+	V3 Version = 3
+)
+
+// PublicKey is the public half of an identity, as sent in an authentication
+// proof.
+type PublicKey struct {
+	version  Version
+	key      crypto.PublicKey
+	bytes    []byte
+	hostname string
+}
+
+// ParsePublicKey parses the public key of an authentication proof: either a
+// DER-encoded RSA public key (V2) or a raw 32 byte Ed25519 public key (V3).
+func ParsePublicKey(publicKeyBytes []byte) (*PublicKey, error) {
+	if len(publicKeyBytes) == ed25519.PublicKeySize {
+		return newEd25519PublicKey(ed25519.PublicKey(publicKeyBytes)), nil
+	}
+
+	publicKey := new(rsa.PublicKey)
+	rest, err := asn1.Unmarshal(publicKeyBytes, publicKey)
+	if err != nil || len(rest) != 0 {
+		return nil, utils.InvalidPublicKeyError
+	}
+	return newRSAPublicKey(publicKey), nil
+}
+
+func newRSAPublicKey(key *rsa.PublicKey) *PublicKey {
+	// DER Encode the Public Key
+	publicKeyBytes, _ := asn1.Marshal(rsa.PublicKey{
+		N: key.N,
+		E: key.E,
+	})
+	return &PublicKey{V2, key, publicKeyBytes, utils.GetTorHostname(publicKeyBytes)}
+}
+
+func newEd25519PublicKey(key ed25519.PublicKey) *PublicKey {
+	publicKeyBytes := append([]byte{}, key...)
+	return &PublicKey{V3, ed25519.PublicKey(publicKeyBytes), publicKeyBytes, utils.GetTorV3Hostname(publicKeyBytes)}
+}
+
+// Version returns the onion service version of the key.
+func (pk *PublicKey) Version() Version {
+	return pk.version
+}
+
+// Hostname returns the onion hostname (without .onion) of the key.
+func (pk *PublicKey) Hostname() string {
+	return pk.hostname
+}
+
+// Bytes returns the key as sent in an authentication proof.
+func (pk *PublicKey) Bytes() []byte {
+	return pk.bytes
+}
+
+// Verify reports whether signature is a valid signature of challenge by the
+// key. V2 keys verify PKCS1v15 signatures of the challenge as a SHA256 digest,
+// V3 keys verify Ed25519 signatures of the challenge.
+func (pk *PublicKey) Verify(challenge []byte, signature []byte) bool {
+	switch key := pk.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, challenge, signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, challenge, signature)
+	}
+	return false
+}
+
+// SignChallenge signs an authentication challenge with signer, which must
+// hold the private key of pk, such that the signature is accepted by Verify.
+// Returns utils.KeyMismatchError if signer holds a different key.
+func (pk *PublicKey) SignChallenge(signer crypto.Signer, challenge []byte) ([]byte, error) {
+	publicKey, ok := signer.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !publicKey.Equal(pk.key) {
+		return nil, utils.KeyMismatchError
+	}
+
+	var opts crypto.SignerOpts = crypto.Hash(0)
+	if pk.version == V2 {
+		opts = crypto.SHA256
+	}
+	return signer.Sign(rand.Reader, challenge, opts)
+}
+
+// Identity is the private key of a ricochet service, along with its public
+// key.
+type Identity struct {
+	*PublicKey
+	key crypto.Signer
+}
+
+// New returns the Identity for key, which must be an *rsa.PrivateKey, an
+// ed25519.PrivateKey or a crypto.Signer accepted by NewFromSigner.
+func New(key crypto.PrivateKey) (*Identity, error) {
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		return New(*k)
+	case crypto.Signer:
+		return NewFromSigner(k)
+	}
+	return nil, utils.UnsupportedKeyError
+}
+
+// NewFromSigner returns the Identity for a key held by signer, e.g. in an
+// agent process or hardware token, whose public key must be an *rsa.PublicKey
+// or an ed25519.PublicKey. The signer is only asked to sign authentication
+// challenges: RSA signers are asked for PKCS1v15 signatures of a SHA256
+// digest, Ed25519 signers for plain signatures.
+func NewFromSigner(signer crypto.Signer) (*Identity, error) {
+	switch publicKey := signer.Public().(type) {
+	case *rsa.PublicKey:
+		return &Identity{newRSAPublicKey(publicKey), signer}, nil
+	case ed25519.PublicKey:
+		return &Identity{newEd25519PublicKey(publicKey), signer}, nil
+	}
+	return nil, utils.UnsupportedKeyError
+}
+
+// PrivateKey returns the private key of the identity, which is the signer
+// given to NewFromSigner if the key is held elsewhere.
+func (id *Identity) PrivateKey() crypto.PrivateKey {
+	return id.key
+}
+
+// Signer returns the signer which holds the private key of the identity.
+func (id *Identity) Signer() crypto.Signer {
+	return id.key
+}
+
+// Sign signs an authentication challenge with the identity, such that the
+// signature is accepted by PublicKey.Verify.
+func (id *Identity) Sign(challenge []byte) ([]byte, error) {
+	return id.SignChallenge(id.key, challenge)
+}
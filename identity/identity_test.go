@@ -0,0 +1,75 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"testing"
+)
+
+func TestEd25519Identity(t *testing.T) {
+	// The secret key of test vector 1 of RFC 8032
+	seed, _ := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	id, err := New(ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		t.Fatalf("Could not create identity: %v", err)
+	}
+	if id.Version() != V3 || id.Hostname() != "25njqamcweflpvkl73j4szahhihoc4xt3ktcgjnpaingr5yhkenl5sid" {
+		t.Errorf("Unexpected identity %v %v", id.Version(), id.Hostname())
+	}
+
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	signature, err := id.Sign(challenge)
+	if err != nil {
+		t.Fatalf("Could not sign challenge: %v", err)
+	}
+
+	publicKey, err := ParsePublicKey(id.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse public key: %v", err)
+	}
+	if publicKey.Hostname() != id.Hostname() || !publicKey.Verify(challenge, signature) {
+		t.Errorf("Expected the proof to verify for %v", id.Hostname())
+	}
+	signature[0] ^= 1
+	if publicKey.Verify(challenge, signature) {
+		t.Errorf("Expected a modified signature not to verify")
+	}
+}
+
+func TestRSAIdentity(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	id, err := New(key)
+	if err != nil {
+		t.Fatalf("Could not create identity: %v", err)
+	}
+	if id.Version() != V2 || len(id.Hostname()) != 16 {
+		t.Errorf("Unexpected identity %v %v", id.Version(), id.Hostname())
+	}
+
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	signature, err := id.Sign(challenge)
+	if err != nil {
+		t.Fatalf("Could not sign challenge: %v", err)
+	}
+	publicKey, err := ParsePublicKey(id.Bytes())
+	if err != nil {
+		t.Fatalf("Could not parse public key: %v", err)
+	}
+	if publicKey.Version() != V2 || publicKey.Hostname() != id.Hostname() || !publicKey.Verify(challenge, signature) {
+		t.Errorf("Expected the proof to verify for %v", id.Hostname())
+	}
+}
+
+func TestParsePublicKeyInvalid(t *testing.T) {
+	if _, err := ParsePublicKey([]byte("not a key")); err == nil {
+		t.Errorf("Expected an invalid public key to be rejected")
+	}
+	if _, err := New("not a key"); err == nil {
+		t.Errorf("Expected an unsupported private key to be rejected")
+	}
+}
@@ -0,0 +1,193 @@
+package identity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/s-rah/go-ricochet/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// rsaKeyBits is the size of the RSA keys used by v2 onion services.
+	rsaKeyBits = 1024
+
+	// torPrivateKeyFile is the name of the key of a v2 onion service in
+	// Tor's HiddenServiceDir.
+	torPrivateKeyFile = "private_key"
+
+	// torV3SecretKeyFile is the name of the key of a v3 onion service in
+	// Tor's HiddenServiceDir.
+	torV3SecretKeyFile = "hs_ed25519_secret_key"
+)
+
+// Generate creates a new identity for an onion service of the given version.
+func Generate(version Version) (*Identity, error) {
+	switch version {
+	case V2:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		return New(key)
+	case V3:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return New(key)
+	}
+	return nil, utils.UnsupportedKeyError
+}
+
+// MarshalPEM encodes the private key of the identity as PEM: V2 keys as a
+// PKCS1 "RSA PRIVATE KEY", the format of Tor's private_key file, and V3 keys
+// as a PKCS8 "PRIVATE KEY".
+func (id *Identity) MarshalPEM() ([]byte, error) {
+	if key, ok := id.key.(*rsa.PrivateKey); ok {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(id.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// PublicKeyDER returns the DER encoding of the identity's public key: a PKCS1
+// RSA public key for V2 identities (the encoding the hostname is derived
+// from) and a PKIX public key for V3 identities.
+func (pk *PublicKey) PublicKeyDER() ([]byte, error) {
+	if pk.version == V2 {
+		return pk.bytes, nil
+	}
+	return x509.MarshalPKIXPublicKey(pk.key)
+}
+
+// Save writes the private key of the identity to filename as PEM, readable
+// only by the current user. An existing file is never overwritten.
+func (id *Identity) Save(filename string) error {
+	pemData, err := id.MarshalPEM()
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(filename, pemData)
+}
+
+// writeKeyFile creates filename, readable only by the current user, with the
+// contents pemData.
+func writeKeyFile(filename string, pemData []byte) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(pemData)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
+
+// ParsePEM parses an identity from PEM data: either a PKCS1 "RSA PRIVATE KEY"
+// or a PKCS8 "PRIVATE KEY" holding an RSA or Ed25519 key. Returns
+// utils.PassphraseRequiredError for keys encrypted by MarshalEncryptedPEM.
+func ParsePEM(pemData []byte) (*Identity, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, utils.InvalidPrivateKeyError
+	}
+	if block.Type == encryptedKeyType {
+		return nil, utils.PassphraseRequiredError
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, utils.InvalidPrivateKeyError
+	}
+	if err != nil {
+		return nil, utils.InvalidPrivateKeyError
+	}
+	return New(key)
+}
+
+// Parse parses an identity from raw key bytes: PEM data (see ParsePEM), a DER
+// encoded PKCS1 or PKCS8 private key, or a 32 byte Ed25519 seed.
+func Parse(keyBytes []byte) (*Identity, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(keyBytes), []byte("-----BEGIN")) {
+		return ParsePEM(keyBytes)
+	}
+	if len(keyBytes) == ed25519.SeedSize {
+		return New(ed25519.NewKeyFromSeed(keyBytes))
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(keyBytes); err == nil {
+		return New(key)
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(keyBytes); err == nil {
+		return New(key)
+	}
+	return nil, utils.InvalidPrivateKeyError
+}
+
+// LoadFile reads an identity from a PEM file, see ParsePEM.
+func LoadFile(filename string) (*Identity, error) {
+	pemData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePEM(pemData)
+}
+
+// LoadTorHiddenServiceDir reads the identity of the onion service whose keys
+// Tor keeps in dir (the service's HiddenServiceDir). Only v2 services are
+// supported. Tor keeps v3 keys (hs_ed25519_secret_key) only in expanded form,
+// from which the Ed25519 seed needed to sign authentication proofs cannot be
+// recovered, so v3 directories return utils.UnsupportedKeyError. Keys for v3
+// services should be created with Generate and published through the Tor
+// control port instead.
+func LoadTorHiddenServiceDir(dir string) (*Identity, error) {
+	id, err := LoadFile(filepath.Join(dir, torPrivateKeyFile))
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(filepath.Join(dir, torV3SecretKeyFile)); statErr == nil {
+			return nil, utils.UnsupportedKeyError
+		}
+	}
+	return id, err
+}
+
+// LoadEnv reads an identity from the environment variable name, which holds
+// either PEM data or the base64 encoding of any key accepted by Parse (which
+// avoids newlines in the variable). Returns utils.KeyNotFoundError if the
+// variable is not set.
+func LoadEnv(name string) (*Identity, error) {
+	value, exists := os.LookupEnv(name)
+	if !exists || value == "" {
+		return nil, utils.KeyNotFoundError
+	}
+	if !strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		keyBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, utils.InvalidPrivateKeyError
+		}
+		return Parse(keyBytes)
+	}
+	return ParsePEM([]byte(value))
+}
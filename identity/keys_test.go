@@ -0,0 +1,136 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/s-rah/go-ricochet/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, version := range []Version{V2, V3} {
+		id, err := Generate(version)
+		if err != nil {
+			t.Fatalf("Could not generate v%v identity: %v", version, err)
+		}
+		filename := filepath.Join(dir, id.Hostname())
+		if err := id.Save(filename); err != nil {
+			t.Fatalf("Could not save v%v identity: %v", version, err)
+		}
+		if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected the key to be saved with mode 0600, got %v %v", info, err)
+		}
+		if err := id.Save(filename); err == nil {
+			t.Errorf("Expected saving over an existing key to fail")
+		}
+
+		loaded, err := LoadFile(filename)
+		if err != nil {
+			t.Fatalf("Could not load v%v identity: %v", version, err)
+		}
+		if loaded.Version() != version || loaded.Hostname() != id.Hostname() {
+			t.Errorf("Loaded identity %v does not match %v", loaded.Hostname(), id.Hostname())
+		}
+
+		der, err := id.PublicKeyDER()
+		if err != nil {
+			t.Fatalf("Could not encode public key: %v", err)
+		}
+		if version == V3 {
+			if _, err := x509.ParsePKIXPublicKey(der); err != nil {
+				t.Errorf("Could not parse v3 public key DER: %v", err)
+			}
+		} else if utils.GetTorHostname(der) != id.Hostname() {
+			t.Errorf("Expected the v2 public key DER to hash to the hostname")
+		}
+	}
+}
+
+func TestLoadTorHiddenServiceDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "hs_ed25519_secret_key"), []byte("== ed25519v1-secret: type0 =="), 0600)
+	if _, err := LoadTorHiddenServiceDir(dir); err != utils.UnsupportedKeyError {
+		t.Errorf("Expected UnsupportedKeyError for a v3 hidden service dir, got %v", err)
+	}
+
+	id, _ := Generate(V2)
+	id.Save(filepath.Join(dir, "private_key"))
+	loaded, err := LoadTorHiddenServiceDir(dir)
+	if err != nil || loaded.Hostname() != id.Hostname() {
+		t.Errorf("Could not load the v2 hidden service key: %v", err)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	id, _ := Generate(V3)
+	pemData, _ := id.MarshalPEM()
+
+	os.Setenv("RICOCHET_TEST_KEY", string(pemData))
+	defer os.Unsetenv("RICOCHET_TEST_KEY")
+	if loaded, err := LoadEnv("RICOCHET_TEST_KEY"); err != nil || loaded.Hostname() != id.Hostname() {
+		t.Errorf("Could not load PEM key from the environment: %v", err)
+	}
+
+	os.Setenv("RICOCHET_TEST_KEY", base64.StdEncoding.EncodeToString(pemData))
+	if loaded, err := LoadEnv("RICOCHET_TEST_KEY"); err != nil || loaded.Hostname() != id.Hostname() {
+		t.Errorf("Could not load base64 key from the environment: %v", err)
+	}
+
+	seed := id.PrivateKey().(ed25519.PrivateKey).Seed()
+	os.Setenv("RICOCHET_TEST_KEY", base64.StdEncoding.EncodeToString(seed))
+	if loaded, err := LoadEnv("RICOCHET_TEST_KEY"); err != nil || loaded.Hostname() != id.Hostname() {
+		t.Errorf("Could not load base64 seed from the environment: %v", err)
+	}
+
+	os.Setenv("RICOCHET_TEST_KEY", "not a key")
+	if _, err := LoadEnv("RICOCHET_TEST_KEY"); err != utils.InvalidPrivateKeyError {
+		t.Errorf("Expected InvalidPrivateKeyError, got %v", err)
+	}
+
+	os.Unsetenv("RICOCHET_TEST_KEY")
+	if _, err := LoadEnv("RICOCHET_TEST_KEY"); err != utils.KeyNotFoundError {
+		t.Errorf("Expected KeyNotFoundError, got %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	v2, _ := Generate(V2)
+	v3, _ := Generate(V3)
+	v2PEM, _ := v2.MarshalPEM()
+	v3PKCS8, _ := x509.MarshalPKCS8PrivateKey(v3.PrivateKey())
+
+	for name, test := range map[string]struct {
+		keyBytes []byte
+		id       *Identity
+	}{
+		"PEM":          {v2PEM, v2},
+		"PKCS1 DER":    {x509.MarshalPKCS1PrivateKey(v2.PrivateKey().(*rsa.PrivateKey)), v2},
+		"PKCS8 DER":    {v3PKCS8, v3},
+		"Ed25519 seed": {v3.PrivateKey().(ed25519.PrivateKey).Seed(), v3},
+	} {
+		id, err := Parse(test.keyBytes)
+		if err != nil || id.Hostname() != test.id.Hostname() {
+			t.Errorf("Could not parse %v key: %v", name, err)
+		}
+	}
+
+	if _, err := Parse([]byte("not a key")); err != utils.InvalidPrivateKeyError {
+		t.Errorf("Expected InvalidPrivateKeyError, got %v", err)
+	}
+}
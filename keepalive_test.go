@@ -0,0 +1,104 @@
+package goricochet
+
+import "testing"
+import "time"
+import "net"
+import "io"
+import "io/ioutil"
+import "github.com/golang/protobuf/proto"
+import "github.com/s-rah/go-ricochet/control"
+import "github.com/s-rah/go-ricochet/utils"
+
+type TestKeepAliveService struct {
+	StandardRicochetService
+	// Disconnected, if set, is signalled when a connection closes.
+	Disconnected chan bool
+}
+
+func (ts *TestKeepAliveService) OnDisconnect(oc *OpenConnection) {
+	ts.StandardRicochetService.OnDisconnect(oc)
+	select {
+	case ts.Disconnected <- true:
+	default:
+	}
+}
+
+func TestKeepAliveResponse(t *testing.T) {
+	ricochetService := new(TestKeepAliveService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+
+	go ricochetService.Listen(ricochetService, 9888)
+
+	time.Sleep(time.Second * 2)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9888")
+	if err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 2))
+
+	conn.Write([]byte{0x49, 0x4D, 0x01, 0x01})
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil || version[0] != 0x01 {
+		t.Fatalf("Version negotiation failed: %v %v", version, err)
+	}
+
+	messageBuilder := new(MessageBuilder)
+	data, _ := messageBuilder.KeepAlive(true)
+	rni := new(utils.RicochetNetwork)
+	rni.SendRicochetPacket(conn, 0, data)
+
+	packet, err := rni.RecvRicochetPacket(conn)
+	if err != nil {
+		t.Fatalf("Did not receive keep alive response: %v", err)
+	}
+	res := new(Protocol_Data_Control.Packet)
+	proto.Unmarshal(packet.Data, res)
+	if packet.Channel != 0 || res.GetKeepAlive() == nil || res.GetKeepAlive().GetResponseRequested() {
+		t.Errorf("Expected keep alive response, got %v", res)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	// A peer which negotiates a version and then never says anything again
+	ln, err := net.Listen("tcp", "127.0.0.1:9889")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 4)
+		io.ReadFull(conn, header)
+		conn.Write([]byte{0x01})
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	ricochetService := new(TestKeepAliveService)
+	err = ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.SetKeepAlive(time.Millisecond*100, 2)
+	ricochetService.Disconnected = make(chan bool, 1)
+
+	go ricochetService.Listen(ricochetService, 9890)
+	_, err = ricochetService.Connect("127.0.0.1:9889|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect to ricochet service:  %v", err)
+	}
+
+	select {
+	case <-ricochetService.Disconnected:
+	case <-time.After(time.Second * 2):
+		t.Errorf("Connection which missed keep alives was not closed")
+	}
+}
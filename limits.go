@@ -0,0 +1,62 @@
+package goricochet
+
+import (
+	"github.com/s-rah/go-ricochet/contact"
+	"github.com/s-rah/go-ricochet/utils"
+)
+
+// Lengths are counted in UTF-16 code units, as they are by Ricochet clients.
+const (
+	messageMaxCharacters  = int(Protocol_Data_ContactRequest.Limits_MessageMaxCharacters)
+	nicknameMaxCharacters = int(Protocol_Data_ContactRequest.Limits_NicknameMaxCharacters)
+)
+
+// utf16Length returns the number of UTF-16 code units needed to encode s.
+func utf16Length(s string) int {
+	length := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			length += 2
+		} else {
+			length++
+		}
+	}
+	return length
+}
+
+// checkMessageLength returns utils.MessageTooLongError if a chat or contact
+// request message is too long.
+func checkMessageLength(message string) error {
+	if utf16Length(message) > messageMaxCharacters {
+		return utils.MessageTooLongError
+	}
+	return nil
+}
+
+// checkNicknameLength returns utils.NicknameTooLongError if a nickname is too
+// long.
+func checkNicknameLength(nick string) error {
+	if utf16Length(nick) > nicknameMaxCharacters {
+		return utils.NicknameTooLongError
+	}
+	return nil
+}
+
+// splitMessage splits message into parts which are each within the chat
+// message limit, without splitting any characters.
+func splitMessage(message string) []string {
+	var parts []string
+	start, length := 0, 0
+	for i, r := range message {
+		units := 1
+		if r >= 0x10000 {
+			units = 2
+		}
+		if length+units > messageMaxCharacters {
+			parts = append(parts, message[start:i])
+			start, length = i, 0
+		}
+		length += units
+	}
+	return append(parts, message[start:])
+}
@@ -0,0 +1,158 @@
+package goricochet
+
+import "testing"
+import "time"
+import "strings"
+import "net"
+import "io"
+import "io/ioutil"
+import "github.com/s-rah/go-ricochet/utils"
+
+func TestUTF16Length(t *testing.T) {
+	if utf16Length("hello") != 5 {
+		t.Errorf("Expected ASCII characters to count as one unit")
+	}
+	if utf16Length("héllo") != 5 {
+		t.Errorf("Expected BMP characters to count as one unit")
+	}
+	if utf16Length("\U0001F600") != 2 {
+		t.Errorf("Expected characters outside the BMP to count as two units")
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	parts := splitMessage(strings.Repeat("a", 4001))
+	if len(parts) != 3 || len(parts[0]) != 2000 || len(parts[1]) != 2000 || len(parts[2]) != 1 {
+		t.Errorf("Unexpected split of 4001 characters into %v parts", len(parts))
+	}
+
+	// A surrogate pair straddling the limit must move to the next part
+	parts = splitMessage(strings.Repeat("a", 1999) + "\U0001F600")
+	if len(parts) != 2 || parts[1] != "\U0001F600" {
+		t.Errorf("Expected the final character to be moved whole to a second part, got %q", parts)
+	}
+
+	if parts := splitMessage("short"); len(parts) != 1 || parts[0] != "short" {
+		t.Errorf("Expected a short message not to be split, got %q", parts)
+	}
+}
+
+func TestOpenConnectionSendLimits(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+	oc := new(OpenConnection)
+	oc.Init(true, conn)
+	defer oc.Close()
+
+	if _, err := oc.SendMessage(3, strings.Repeat("a", 2001)); err != utils.MessageTooLongError {
+		t.Errorf("Expected MessageTooLongError, got %v", err)
+	}
+	if _, err := oc.SendMessage(3, strings.Repeat("a", 2000)); err != nil {
+		t.Errorf("Expected a message at the limit to be sent, got %v", err)
+	}
+	if err := oc.SendContactRequest(3, strings.Repeat("a", 31), "hello"); err != utils.NicknameTooLongError {
+		t.Errorf("Expected NicknameTooLongError, got %v", err)
+	}
+	if err := oc.SendContactRequest(3, "nick", strings.Repeat("\U0001F600", 1001)); err != utils.MessageTooLongError {
+		t.Errorf("Expected MessageTooLongError, got %v", err)
+	}
+	messageIDs, err := oc.SendSplitMessage(3, strings.Repeat("a", 4500))
+	if err != nil || len(messageIDs) != 3 {
+		t.Errorf("Expected the message to be split in to 3, got %v %v", messageIDs, err)
+	}
+}
+
+type LimitsTestService struct {
+	StandardRicochetService
+	exceeded chan error
+	acks     chan bool
+	failed   chan string
+}
+
+func (lts *LimitsTestService) IsKnownContact(hostname string) bool {
+	return true
+}
+
+func (lts *LimitsTestService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
+	lts.StandardRicochetService.OnAuthenticationResult(oc, channelID, result, isKnownContact)
+	oc.OpenChatChannel(5)
+
+	// Bypass the outbound checks to send an oversized contact request
+	messageBuilder := new(MessageBuilder)
+	data, _ := messageBuilder.OpenContactRequestChannel(7, strings.Repeat("a", 31), "hello")
+	oc.setChannel(7, "im.ricochet.contact.request")
+	oc.SendPacket(0, data)
+}
+
+func (lts *LimitsTestService) OnOpenChannelRequestSuccess(oc *OpenConnection, channelID int32) {
+	messageBuilder := new(MessageBuilder)
+	data, _ := messageBuilder.ChatMessage(strings.Repeat("a", 2001), 1, 0)
+	oc.SendPacket(channelID, data)
+}
+
+func (lts *LimitsTestService) OnChatMessageAck(oc *OpenConnection, channelID int32, messageID int32, accepted bool) {
+	lts.acks <- accepted
+}
+
+func (lts *LimitsTestService) OnFailedChannelOpen(oc *OpenConnection, channelID int32, errorType string) {
+	lts.failed <- errorType
+}
+
+func (lts *LimitsTestService) OnLimitExceeded(oc *OpenConnection, channelID int32, err error) {
+	lts.exceeded <- err
+}
+
+func TestInboundLimits(t *testing.T) {
+	ricochetService := new(LimitsTestService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.exceeded = make(chan error, 2)
+	go ricochetService.Listen(ricochetService, 9916)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(LimitsTestService)
+	ricochetService2.Init("./private_key")
+	ricochetService2.acks = make(chan bool, 1)
+	ricochetService2.failed = make(chan string, 1)
+	go ricochetService2.Listen(ricochetService2, 9917)
+
+	_, err = ricochetService2.Connect("127.0.0.1:9916|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect to ricochet service: %v", err)
+	}
+
+	exceeded := make(map[error]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-ricochetService.exceeded:
+			exceeded[err] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Timed out waiting for limits to be enforced")
+		}
+	}
+	if !exceeded[utils.NicknameTooLongError] || !exceeded[utils.MessageTooLongError] {
+		t.Errorf("Expected both limits to be reported, got %v", exceeded)
+	}
+
+	select {
+	case accepted := <-ricochetService2.acks:
+		if accepted {
+			t.Errorf("Expected the oversized chat message to be rejected")
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("Timed out waiting for chat message ack")
+	}
+
+	select {
+	case errorType := <-ricochetService2.failed:
+		if errorType != "BadUsageError" {
+			t.Errorf("Expected the oversized contact request to fail with BadUsageError, got %v", errorType)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("Timed out waiting for contact request to be rejected")
+	}
+}
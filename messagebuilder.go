@@ -6,7 +6,6 @@ import (
 	"github.com/s-rah/go-ricochet/chat"
 	"github.com/s-rah/go-ricochet/contact"
 	"github.com/s-rah/go-ricochet/control"
-	"github.com/s-rah/go-ricochet/utils"
 )
 
 // MessageBuilder allows a client to construct specific data packets for the
@@ -56,6 +55,42 @@ func (mb *MessageBuilder) RejectOpenChannel(channelID int32, error string) ([]by
 	return proto.Marshal(pc)
 }
 
+// KeepAlive constructs a keep alive message, optionally requesting that the
+// peer responds with its own keep alive.
+func (mb *MessageBuilder) KeepAlive(responseRequested bool) ([]byte, error) {
+	ka := &Protocol_Data_Control.KeepAlive{
+		ResponseRequested: proto.Bool(responseRequested),
+	}
+	pc := &Protocol_Data_Control.Packet{
+		KeepAlive: ka,
+	}
+	return proto.Marshal(pc)
+}
+
+// EnableFeatures constructs a message requesting that the peer enables the
+// given features on this connection.
+func (mb *MessageBuilder) EnableFeatures(features []string) ([]byte, error) {
+	ef := &Protocol_Data_Control.EnableFeatures{
+		Feature: features,
+	}
+	pc := &Protocol_Data_Control.Packet{
+		EnableFeatures: ef,
+	}
+	return proto.Marshal(pc)
+}
+
+// FeaturesEnabled constructs a response to an EnableFeatures message listing
+// the features which have been enabled.
+func (mb *MessageBuilder) FeaturesEnabled(features []string) ([]byte, error) {
+	fe := &Protocol_Data_Control.FeaturesEnabled{
+		Feature: features,
+	}
+	pc := &Protocol_Data_Control.Packet{
+		FeaturesEnabled: fe,
+	}
+	return proto.Marshal(pc)
+}
+
 // ConfirmAuthChannel constructs a message to acknowledge a previous open channel operation.
 func (mb *MessageBuilder) ConfirmAuthChannel(channelID int32, serverCookie [16]byte) ([]byte, error) {
 	cr := &Protocol_Data_Control.ChannelResult{
@@ -64,7 +99,9 @@ func (mb *MessageBuilder) ConfirmAuthChannel(channelID int32, serverCookie [16]b
 	}
 
 	err := proto.SetExtension(cr, Protocol_Data_AuthHiddenService.E_ServerCookie, serverCookie[:])
-	utils.CheckError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	pc := &Protocol_Data_Control.Packet{
 		ChannelResult: cr,
@@ -87,7 +124,9 @@ func (mb *MessageBuilder) OpenContactRequestChannel(channelID int32, nick string
 	}
 
 	err := proto.SetExtension(oc, Protocol_Data_ContactRequest.E_ContactRequest, contactRequest)
-	utils.CheckError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	pc := &Protocol_Data_Control.Packet{
 		OpenChannel: oc,
@@ -109,7 +148,9 @@ func (mb *MessageBuilder) ReplyToContactRequestOnResponse(channelID int32, statu
 	}
 
 	err := proto.SetExtension(cr, Protocol_Data_ContactRequest.E_Response, contactRequest)
-	utils.CheckError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	pc := &Protocol_Data_Control.Packet{
 		ChannelResult: cr,
@@ -135,7 +176,9 @@ func (mb *MessageBuilder) OpenAuthenticationChannel(channelID int32, clientCooki
 		ChannelType:       proto.String("im.ricochet.auth.hidden-service"),
 	}
 	err := proto.SetExtension(oc, Protocol_Data_AuthHiddenService.E_ClientCookie, clientCookie[:])
-	utils.CheckError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	pc := &Protocol_Data_Control.Packet{
 		OpenChannel: oc,
@@ -174,23 +217,29 @@ func (mb *MessageBuilder) AuthResult(accepted bool, isKnownContact bool) ([]byte
 	return proto.Marshal(ahsPacket)
 }
 
-// ChatMessage constructs a chat message with the given content.
-func (mb *MessageBuilder) ChatMessage(message string, messageID int32) ([]byte, error) {
+// ChatMessage constructs a chat message with the given content. timeDelta is
+// the number of seconds since the message was written, and is sent as the
+// (negative) time_delta if non-zero.
+func (mb *MessageBuilder) ChatMessage(message string, messageID int32, timeDelta int64) ([]byte, error) {
 	cm := &Protocol_Data_Chat.ChatMessage{
 		MessageId:   proto.Uint32(uint32(messageID)),
 		MessageText: proto.String(message),
 	}
+	if timeDelta > 0 {
+		cm.TimeDelta = proto.Int64(-timeDelta)
+	}
 	chatPacket := &Protocol_Data_Chat.Packet{
 		ChatMessage: cm,
 	}
 	return proto.Marshal(chatPacket)
 }
 
-// AckChatMessage constructs a chat message acknowledgement.
-func (mb *MessageBuilder) AckChatMessage(messageID int32) ([]byte, error) {
+// AckChatMessage constructs a chat message acknowledgement, accepting or
+// rejecting the message.
+func (mb *MessageBuilder) AckChatMessage(messageID int32, accepted bool) ([]byte, error) {
 	cr := &Protocol_Data_Chat.ChatAcknowledge{
 		MessageId: proto.Uint32(uint32(messageID)),
-		Accepted:  proto.Bool(true),
+		Accepted:  proto.Bool(accepted),
 	}
 	pc := &Protocol_Data_Chat.Packet{
 		ChatAcknowledge: cr,
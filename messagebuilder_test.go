@@ -1,6 +1,8 @@
 package goricochet
 
 import "testing"
+import "github.com/golang/protobuf/proto"
+import "github.com/s-rah/go-ricochet/chat"
 
 func TestOpenChatChannel(t *testing.T) {
 	messageBuilder := new(MessageBuilder)
@@ -31,9 +33,45 @@ func TestOpenAuthenticationChannel(t *testing.T) {
 
 func TestChatMessage(t *testing.T) {
 	messageBuilder := new(MessageBuilder)
-	_, err := messageBuilder.ChatMessage("Hello World", 0)
+	_, err := messageBuilder.ChatMessage("Hello World", 0, 0)
 	if err != nil {
 		t.Errorf("Error building chat message: %s", err)
 	}
 	// TODO: More Indepth Test Of Output
 }
+
+func TestAckChatMessage(t *testing.T) {
+	messageBuilder := new(MessageBuilder)
+	data, err := messageBuilder.AckChatMessage(7, false)
+	if err != nil {
+		t.Errorf("Error building chat message ack: %s", err)
+	}
+	res := new(Protocol_Data_Chat.Packet)
+	if err := proto.Unmarshal(data, res); err != nil {
+		t.Fatalf("Error parsing chat message ack: %s", err)
+	}
+	if res.GetChatAcknowledge().GetMessageId() != 7 || res.GetChatAcknowledge().GetAccepted() {
+		t.Errorf("Unexpected chat message ack: %v", res.GetChatAcknowledge())
+	}
+}
+
+func TestChatMessageTimeDelta(t *testing.T) {
+	messageBuilder := new(MessageBuilder)
+	data, err := messageBuilder.ChatMessage("Hello World", 1, 90)
+	if err != nil {
+		t.Errorf("Error building chat message: %s", err)
+	}
+	res := new(Protocol_Data_Chat.Packet)
+	if err := proto.Unmarshal(data, res); err != nil {
+		t.Fatalf("Error parsing chat message: %s", err)
+	}
+	if res.GetChatMessage().GetTimeDelta() != -90 {
+		t.Errorf("Expected a time delta of -90, got %v", res.GetChatMessage().GetTimeDelta())
+	}
+
+	data, _ = messageBuilder.ChatMessage("Hello World", 1, 0)
+	proto.Unmarshal(data, res)
+	if res.GetChatMessage().TimeDelta != nil {
+		t.Errorf("Expected no time delta for a message written now")
+	}
+}
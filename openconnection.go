@@ -1,51 +1,283 @@
 package goricochet
 
 import (
+	"context"
 	"crypto"
-	"crypto/rsa"
-	"encoding/asn1"
+	"github.com/s-rah/go-ricochet/identity"
 	"github.com/s-rah/go-ricochet/utils"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// outboundQueueSize is the number of packets which may be waiting for the
+// writer before further sends block.
+const outboundQueueSize = 32
+
+// outboundPacket is a packet waiting to be written to the connection, along
+// with a channel on which the result of the write is reported.
+type outboundPacket struct {
+	channel int32
+	data    []byte
+	result  chan error
+}
+
 // OpenConnection encapsulates the state required to maintain a connection to
 // a ricochet service.
 // Notably OpenConnection does not enforce limits on the channelIDs, channel Assignments
 // or the direction of messages. These are considered to be service enforced rules.
 // (and services are considered to be the best to define them).
+//
+// All methods of OpenConnection are safe to call from multiple goroutines.
+// Outbound packets are written, in order, by a single writer goroutine.
 type OpenConnection struct {
-	conn        net.Conn
-	authHandler map[int32]*AuthenticationHandler
-	channels    map[int32]string
-	rni         utils.RicochetNetworkInterface
-
-	Client        bool
-	IsAuthed      bool
-	MyHostname    string
-	OtherHostname string
-	Closed        bool
+	conn     net.Conn
+	channels map[int32]string
+	rni      utils.RicochetNetworkInterface
+
+	// lock protects auth, channels, the feature maps, the authentication
+	// facts, the hostnames and closed.
+	lock      sync.Mutex
+	auth      authentication
+	closed    bool
+	closeOnce sync.Once
+	closing   chan struct{}
+	outbound  chan outboundPacket
+
+	// Facts established by the authentication handshake: the service's
+	// verdict (SetAuthed), whether the peer proved its identity, whether the
+	// server accepted our proof and whether it reported us as a known contact.
+	isAuthed    bool
+	peerProved  bool
+	selfProved  bool
+	knownToPeer bool
+
+	// dialledHostname is the hostname we connected to, for outbound
+	// connections. It does not change after Init.
+	dialledHostname string
+
+	// authDone is closed once the authentication handshake has finished,
+	// auth.state holds the outcome.
+	authDone chan struct{}
+
+	// registry, if set, is where the connection is registered once
+	// authenticated.
+	registry *connectionRegistry
+
+	// Features we have asked the peer to enable, and those which have been
+	// agreed for this connection.
+	requestedFeatures map[string]bool
+	features          map[string]bool
+
+	// The last message ID sent on each chat channel.
+	messageIDs map[int32]uint32
+
+	// The last channel ID allocated by nextChannelID.
+	lastChannelID int32
+
+	// Number of keep alive requests the peer has not yet responded to.
+	pendingKeepAlives int32
+
+	// Client is true if we initiated the connection. It does not change
+	// after Init.
+	Client bool
+
+	// myHostname and otherHostname are set while the connection is being
+	// established and authenticated, see MyHostname and OtherHostname.
+	myHostname    string
+	otherHostname string
 }
 
 // Init initializes a OpenConnection object to a default state.
 func (oc *OpenConnection) Init(outbound bool, conn net.Conn) {
 	oc.conn = conn
-	oc.authHandler = make(map[int32]*AuthenticationHandler)
+	oc.auth = authentication{changed: make(chan struct{}), entered: time.Now()}
 	oc.channels = make(map[int32]string)
+	oc.requestedFeatures = make(map[string]bool)
+	oc.features = make(map[string]bool)
+	oc.messageIDs = make(map[int32]uint32)
 	oc.rni = new(utils.RicochetNetwork)
+	oc.closing = make(chan struct{})
+	oc.outbound = make(chan outboundPacket, outboundQueueSize)
+	oc.authDone = make(chan struct{})
 
 	oc.Client = outbound
-	oc.IsAuthed = false
-	oc.MyHostname = ""
-	oc.OtherHostname = ""
+	oc.isAuthed = false
+	oc.closed = false
+	oc.myHostname = ""
+	oc.otherHostname = ""
+	oc.dialledHostname = ""
+
+	go oc.writer()
+}
+
+// writer writes queued packets to the connection until it is closed.
+func (oc *OpenConnection) writer() {
+	for {
+		select {
+		case packet := <-oc.outbound:
+			packet.result <- oc.rni.SendRicochetPacket(oc.conn, packet.channel, packet.data)
+		case <-oc.closing:
+			return
+		}
+	}
+}
+
+// IsAuthed returns true if the connection has been authenticated: for
+// connections we accepted the peer has proved its identity, for connections we
+// made the server has accepted our proof. In both cases the service must also
+// have accepted the outcome with SetAuthed.
+func (oc *OpenConnection) IsAuthed() bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	if oc.Client {
+		return oc.isAuthed && oc.selfProved
+	}
+	return oc.isAuthed && oc.peerProved
+}
+
+// SetAuthed records the service's verdict on the authentication handshake.
+// It cannot authenticate a connection on its own, see IsAuthed.
+func (oc *OpenConnection) SetAuthed(authed bool) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	oc.isAuthed = authed
+}
+
+// MyHostname returns the hostname we identify as on this connection, as set
+// by SetMyHostname.
+func (oc *OpenConnection) MyHostname() string {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.myHostname
+}
+
+// SetMyHostname sets the hostname we identify as on this connection. It must
+// be called before authentication starts, usually from
+// RicochetService.OnConnect.
+func (oc *OpenConnection) SetMyHostname(hostname string) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	oc.myHostname = hostname
+}
+
+// OtherHostname returns the hostname of the peer: for connections we made the
+// hostname we connected to, for connections we accepted the hostname the peer
+// proved it holds the key of, or "" until it has.
+func (oc *OpenConnection) OtherHostname() string {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.otherHostname
+}
+
+// setOtherHostname sets the hostname of the peer, normalised with
+// utils.ParseOnionHostname so it can be used as a key.
+func (oc *OpenConnection) setOtherHostname(hostname string) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	oc.otherHostname = utils.ParseOnionHostname(hostname)
+}
+
+// DialledHostname returns the hostname we connected to, or "" if the peer
+// connected to us. When dialled through Tor, Tor ensures the peer holds the key
+// of that onion service; direct connections ("127.0.0.1:port|hostname") carry
+// no such guarantee, and ricochet servers never prove their identity.
+func (oc *OpenConnection) DialledHostname() string {
+	return oc.dialledHostname
+}
+
+// PeerProvedIdentity returns true if the peer has sent a valid proof that it
+// holds the key of OtherHostname. Only clients send proofs.
+func (oc *OpenConnection) PeerProvedIdentity() bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.peerProved
+}
+
+// ProvedOwnIdentity returns true if the server has accepted our proof of
+// identity. Only clients send proofs.
+func (oc *OpenConnection) ProvedOwnIdentity() bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.selfProved
+}
+
+// KnownToPeer returns true if the server reported us as a known contact when
+// it accepted our proof.
+func (oc *OpenConnection) KnownToPeer() bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.knownToPeer
+}
+
+// authenticationResultReceived records the server's verdict on our proof.
+func (oc *OpenConnection) authenticationResultReceived(accepted bool, isKnownContact bool) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	oc.selfProved = accepted
+	oc.knownToPeer = accepted && isKnownContact
+}
+
+// WaitForAuthentication blocks until the authentication handshake on this
+// connection has finished, returning whether the proof was accepted. Returns
+// the reason the handshake failed, if it failed for any reason other than the
+// proof being rejected, or an error if ctx is done or the connection closes
+// first.
+func (oc *OpenConnection) WaitForAuthentication(ctx context.Context) (bool, error) {
+	select {
+	case <-oc.authDone:
+		return oc.authResult()
+	case <-oc.closing:
+		select {
+		case <-oc.authDone:
+			return oc.authResult()
+		default:
+		}
+		return false, utils.ConnectionClosedError
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// authResult returns the outcome of a finished authentication handshake, see
+// WaitForAuthentication.
+func (oc *OpenConnection) authResult() (bool, error) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	if oc.auth.state == AuthAccepted {
+		return true, nil
+	}
+	if oc.auth.err == utils.AuthenticationRejectedError {
+		return false, nil
+	}
+	return false, oc.auth.err
+}
+
+// Done returns a channel which is closed when the connection closes.
+func (oc *OpenConnection) Done() <-chan struct{} {
+	return oc.closing
+}
+
+// IsClosed returns true once the connection has been closed.
+func (oc *OpenConnection) IsClosed() bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.closed
 }
 
 // UnsetChannel removes a type association from the channel.
 func (oc *OpenConnection) UnsetChannel(channel int32) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
 	oc.channels[channel] = "none"
+	delete(oc.messageIDs, channel)
 }
 
 // GetChannelType returns the type of the channel on this connection
 func (oc *OpenConnection) GetChannelType(channel int32) string {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
 	if val, ok := oc.channels[channel]; ok {
 		return val
 	}
@@ -53,11 +285,41 @@ func (oc *OpenConnection) GetChannelType(channel int32) string {
 }
 
 func (oc *OpenConnection) setChannel(channel int32, channelType string) {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
 	oc.channels[channel] = channelType
+	delete(oc.messageIDs, channel)
+}
+
+// nextChannelID allocates an unused channel ID for a channel opened by us: odd
+// if we are the client, even otherwise. IDs are not reused on a connection.
+func (oc *OpenConnection) nextChannelID() int32 {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	if oc.lastChannelID == 0 && oc.Client {
+		oc.lastChannelID = -1
+	}
+	for {
+		oc.lastChannelID += 2
+		if _, used := oc.channels[oc.lastChannelID]; !used {
+			return oc.lastChannelID
+		}
+	}
+}
+
+// nextMessageID allocates the ID of the next message sent on channel. IDs
+// start at 1 for each channel and increase with every message.
+func (oc *OpenConnection) nextMessageID(channel int32) int32 {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	oc.messageIDs[channel]++
+	return int32(oc.messageIDs[channel])
 }
 
 // HasChannel returns true if the connection has a channel of an associated type, false otherwise
 func (oc *OpenConnection) HasChannel(channelType string) bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
 	for _, val := range oc.channels {
 		if val == channelType {
 			return true
@@ -69,92 +331,237 @@ func (oc *OpenConnection) HasChannel(channelType string) bool {
 // CloseChannel closes a given channel
 // Prerequisites:
 //              * Must have previously connected to a service
-func (oc *OpenConnection) CloseChannel(channel int32) {
+func (oc *OpenConnection) CloseChannel(channel int32) error {
 	oc.UnsetChannel(channel)
-	oc.rni.SendRicochetPacket(oc.conn, channel, []byte{})
+	return oc.send(channel, []byte{})
+}
+
+// closeGracefully closes every open channel and then closes the connection for
+// writing, leaving the peer to close the connection once it has read
+// everything we sent. Connections which do not support closing for writing are
+// closed immediately.
+func (oc *OpenConnection) closeGracefully() {
+	oc.lock.Lock()
+	channels := make([]int32, 0, len(oc.channels))
+	for channel, channelType := range oc.channels {
+		if channelType != "none" {
+			channels = append(channels, channel)
+		}
+	}
+	oc.lock.Unlock()
+
+	for _, channel := range channels {
+		if oc.CloseChannel(channel) != nil {
+			break
+		}
+	}
+
+	if cw, ok := oc.conn.(interface {
+		CloseWrite() error
+	}); ok && cw.CloseWrite() == nil {
+		return
+	}
+	oc.Close()
 }
 
-// Close closes the entire connection
+// Close closes the entire connection. Any sends waiting on the writer fail
+// with utils.ConnectionClosedError.
 func (oc *OpenConnection) Close() {
-	oc.conn.Close()
-	oc.Closed = true
+	oc.closeOnce.Do(func() {
+		oc.lock.Lock()
+		oc.closed = true
+		oc.lock.Unlock()
+		close(oc.closing)
+		oc.conn.Close()
+	})
 }
 
-// Authenticate opens an Authentication Channel and send a client cookie
+// SendKeepAlive sends a keep alive message on the control channel. If
+// responseRequested is true the peer is expected to reply with a keep alive of
+// its own.
 // Prerequisites:
 //              * Must have previously connected to a service
-func (oc *OpenConnection) Authenticate(channel int32) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) SendKeepAlive(responseRequested bool) error {
+	messageBuilder := new(MessageBuilder)
+	data, err := messageBuilder.KeepAlive(responseRequested)
+	if err != nil {
+		return err
+	}
 
-	oc.authHandler[channel] = new(AuthenticationHandler)
+	if responseRequested {
+		atomic.AddInt32(&oc.pendingKeepAlives, 1)
+	}
+	return oc.send(0, data)
+}
+
+// keepAliveReceived records that the peer responded to our keep alive requests.
+func (oc *OpenConnection) keepAliveReceived() {
+	atomic.StoreInt32(&oc.pendingKeepAlives, 0)
+}
+
+// missedKeepAlives returns the number of keep alive requests the peer has
+// not responded to.
+func (oc *OpenConnection) missedKeepAlives() int {
+	return int(atomic.LoadInt32(&oc.pendingKeepAlives))
+}
+
+// EnableFeatures asks the peer to enable the given features on this connection.
+// The peer will respond with the subset of features it has enabled, see
+// RicochetService.OnFeaturesEnabled.
+// Prerequisites:
+//              * Must have previously connected to a service
+func (oc *OpenConnection) EnableFeatures(features []string) error {
 	messageBuilder := new(MessageBuilder)
-	data, err := messageBuilder.OpenAuthenticationChannel(channel, oc.authHandler[channel].GenClientCookie())
-	utils.CheckError(err)
+	data, err := messageBuilder.EnableFeatures(features)
+	if err != nil {
+		return err
+	}
+
+	oc.lock.Lock()
+	for _, feature := range features {
+		oc.requestedFeatures[feature] = true
+	}
+	oc.lock.Unlock()
+	return oc.send(0, data)
+}
+
+// SendFeaturesEnabled responds to a request to enable features with those
+// features which are now enabled on this connection.
+// Prerequisites:
+//              * Must have previously received an EnableFeatures request
+func (oc *OpenConnection) SendFeaturesEnabled(features []string) error {
+	messageBuilder := new(MessageBuilder)
+	data, err := messageBuilder.FeaturesEnabled(features)
+	if err != nil {
+		return err
+	}
+
+	oc.lock.Lock()
+	for _, feature := range features {
+		oc.features[feature] = true
+	}
+	oc.lock.Unlock()
+	return oc.send(0, data)
+}
+
+// setFeaturesEnabled records the features the peer has enabled in response to
+// our request, ignoring any that we did not ask for. Returns the agreed set.
+func (oc *OpenConnection) setFeaturesEnabled(features []string) []string {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	enabled := []string{}
+	for _, feature := range features {
+		if oc.requestedFeatures[feature] {
+			oc.features[feature] = true
+			enabled = append(enabled, feature)
+		}
+	}
+	return enabled
+}
+
+// HasFeature returns true if the given feature has been negotiated on this
+// connection, false otherwise.
+func (oc *OpenConnection) HasFeature(feature string) bool {
+	oc.lock.Lock()
+	defer oc.lock.Unlock()
+	return oc.features[feature]
+}
+
+// Authenticate opens an Authentication Channel and send a client cookie
+// Prerequisites:
+//              * Must have previously connected to a service
+//              * Authentication must not have started (AuthState is AuthNone)
+func (oc *OpenConnection) Authenticate(channel int32) error {
+	authHandler, err := oc.beginAuthentication(channel, AuthAwaitingChallenge)
+	if err != nil {
+		return err
+	}
+	messageBuilder := new(MessageBuilder)
+	data, err := messageBuilder.OpenAuthenticationChannel(channel, authHandler.GenClientCookie())
+	if err != nil {
+		return err
+	}
 
 	oc.setChannel(channel, "im.ricochet.auth.hidden-service")
-	oc.rni.SendRicochetPacket(oc.conn, 0, data)
+	return oc.send(0, data)
 }
 
 // ConfirmAuthChannel responds to a new authentication request.
 // Prerequisites:
 //              * Must have previously connected to a service
-func (oc *OpenConnection) ConfirmAuthChannel(channel int32, clientCookie [16]byte) {
-	defer utils.RecoverFromError()
-
-	oc.authHandler[channel] = new(AuthenticationHandler)
-	oc.authHandler[channel].AddClientCookie(clientCookie[:])
+//              * Authentication must not have started (AuthState is AuthNone)
+func (oc *OpenConnection) ConfirmAuthChannel(channel int32, clientCookie [16]byte) error {
+	authHandler, err := oc.beginAuthentication(channel, AuthAwaitingProof)
+	if err != nil {
+		return err
+	}
+	authHandler.AddClientCookie(clientCookie[:])
 	messageBuilder := new(MessageBuilder)
-	data, err := messageBuilder.ConfirmAuthChannel(channel, oc.authHandler[channel].GenServerCookie())
-	utils.CheckError(err)
+	data, err := messageBuilder.ConfirmAuthChannel(channel, authHandler.GenServerCookie())
+	if err != nil {
+		return err
+	}
 
 	oc.setChannel(channel, "im.ricochet.auth.hidden-service")
-	oc.rni.SendRicochetPacket(oc.conn, 0, data)
+	return oc.send(0, data)
 }
 
-// SendProof sends an authentication proof in response to a challenge.
+// SendProof sends an authentication proof for the identity with publicKey in
+// response to a challenge. The proof is signed by signer, which may hold the key
+// in memory (e.g. Identity.Signer()) or elsewhere.
 // Prerequisites:
 //              * Must have previously connected to a service
-//              * channel must be of type auth
-func (oc *OpenConnection) SendProof(channel int32, serverCookie [16]byte, publicKeyBytes []byte, privateKey *rsa.PrivateKey) {
-
-	if oc.authHandler[channel] == nil {
-		return // NoOp
+//              * channel must be the authentication channel, in AuthAwaitingChallenge
+//              * signer must hold the private key of publicKey
+func (oc *OpenConnection) SendProof(channel int32, serverCookie [16]byte, publicKey *identity.PublicKey, signer crypto.Signer) error {
+	authHandler, err := oc.expectAuthState(channel, AuthAwaitingChallenge)
+	if err != nil {
+		return err
 	}
 
-	oc.authHandler[channel].AddServerCookie(serverCookie[:])
+	authHandler.AddServerCookie(serverCookie[:])
 
-	challenge := oc.authHandler[channel].GenChallenge(oc.MyHostname, oc.OtherHostname)
-	signature, _ := rsa.SignPKCS1v15(nil, privateKey, crypto.SHA256, challenge)
+	challenge := authHandler.GenChallenge(oc.MyHostname(), oc.OtherHostname())
+	signature, err := publicKey.SignChallenge(signer, challenge)
+	if err != nil {
+		return err
+	}
 
-	defer utils.RecoverFromError()
 	messageBuilder := new(MessageBuilder)
-	data, err := messageBuilder.Proof(publicKeyBytes, signature)
-	utils.CheckError(err)
+	data, err := messageBuilder.Proof(publicKey.Bytes(), signature)
+	if err != nil {
+		return err
+	}
 
-	oc.rni.SendRicochetPacket(oc.conn, channel, data)
+	if !oc.advanceAuthentication(AuthAwaitingChallenge, AuthAwaitingResult) {
+		return utils.AuthenticationProtocolError
+	}
+	return oc.send(channel, data)
 }
 
 // ValidateProof determines if the given public key and signature align with the
-// already established challenge vector for this communication
+// already established challenge vector for this communication. Both RSA (v2)
+// and Ed25519 (v3) public keys are accepted.
 // Prerequisites:
 //              * Must have previously connected to a service
 //              * Client and Server must have already sent their respective cookies (Authenticate and ConfirmAuthChannel)
 func (oc *OpenConnection) ValidateProof(channel int32, publicKeyBytes []byte, signature []byte) bool {
-
-	if oc.authHandler[channel] == nil {
+	authHandler, err := oc.expectAuthState(channel, AuthAwaitingProof)
+	if err != nil {
 		return false
 	}
 
-	provisionalHostname := utils.GetTorHostname(publicKeyBytes)
-	publicKey := new(rsa.PublicKey)
-	_, err := asn1.Unmarshal(publicKeyBytes, publicKey)
+	publicKey, err := identity.ParsePublicKey(publicKeyBytes)
 	if err != nil {
 		return false
 	}
-	challenge := oc.authHandler[channel].GenChallenge(provisionalHostname, oc.MyHostname)
-	err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, challenge[:], signature)
-	if err == nil {
-		oc.OtherHostname = provisionalHostname
+	provisionalHostname := publicKey.Hostname()
+	challenge := authHandler.GenChallenge(provisionalHostname, oc.MyHostname())
+	if publicKey.Verify(challenge, signature) {
+		oc.lock.Lock()
+		oc.otherHostname = provisionalHostname
+		oc.peerProved = true
+		oc.lock.Unlock()
 		return true
 	}
 	return false
@@ -165,110 +572,124 @@ func (oc *OpenConnection) ValidateProof(channel int32, publicKeyBytes []byte, si
 // Prerequisites:
 //              * Must have previously connected to a service
 //              * channel must be of type auth
-func (oc *OpenConnection) SendAuthenticationResult(channel int32, accepted bool, isKnownContact bool) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) SendAuthenticationResult(channel int32, accepted bool, isKnownContact bool) error {
 	messageBuilder := new(MessageBuilder)
 	data, err := messageBuilder.AuthResult(accepted, isKnownContact)
-	utils.CheckError(err)
-	oc.rni.SendRicochetPacket(oc.conn, channel, data)
+	if err != nil {
+		return err
+	}
+	return oc.send(channel, data)
 }
 
 // OpenChatChannel opens a new chat channel with the given id
 // Prerequisites:
 //              * Must have previously connected to a service
 //              * If acting as the client, id must be odd, else even
-func (oc *OpenConnection) OpenChatChannel(channel int32) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) OpenChatChannel(channel int32) error {
 	messageBuilder := new(MessageBuilder)
 	data, err := messageBuilder.OpenChannel(channel, "im.ricochet.chat")
-	utils.CheckError(err)
+	if err != nil {
+		return err
+	}
 
 	oc.setChannel(channel, "im.ricochet.chat")
-	oc.rni.SendRicochetPacket(oc.conn, 0, data)
+	return oc.send(0, data)
 }
 
 // OpenChannel opens a new chat channel with the given id
 // Prerequisites:
 //              * Must have previously connected to a service
 //              * If acting as the client, id must be odd, else even
-func (oc *OpenConnection) OpenChannel(channel int32, channelType string) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) OpenChannel(channel int32, channelType string) error {
 	messageBuilder := new(MessageBuilder)
 	data, err := messageBuilder.OpenChannel(channel, channelType)
-	utils.CheckError(err)
+	if err != nil {
+		return err
+	}
 
 	oc.setChannel(channel, channelType)
-	oc.rni.SendRicochetPacket(oc.conn, 0, data)
+	return oc.send(0, data)
 }
 
 // AckOpenChannel acknowledges a previously received open channel message
 // Prerequisites:
 //             * Must have previously connected and authenticated to a service
-func (oc *OpenConnection) AckOpenChannel(channel int32, channeltype string) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) AckOpenChannel(channel int32, channeltype string) error {
 	messageBuilder := new(MessageBuilder)
 
 	data, err := messageBuilder.AckOpenChannel(channel)
-	utils.CheckError(err)
+	if err != nil {
+		return err
+	}
 
 	oc.setChannel(channel, channeltype)
-	oc.rni.SendRicochetPacket(oc.conn, 0, data)
+	return oc.send(0, data)
 }
 
 // RejectOpenChannel acknowledges a rejects a previously received open channel message
 // Prerequisites:
 //             * Must have previously connected
-func (oc *OpenConnection) RejectOpenChannel(channel int32, errortype string) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) RejectOpenChannel(channel int32, errortype string) error {
 	messageBuilder := new(MessageBuilder)
 	data, err := messageBuilder.RejectOpenChannel(channel, errortype)
-	utils.CheckError(err)
+	if err != nil {
+		return err
+	}
 
-	oc.rni.SendRicochetPacket(oc.conn, 0, data)
+	return oc.send(0, data)
 }
 
-// SendContactRequest initiates a contact request to the server.
+// SendContactRequest initiates a contact request to the server. Returns
+// utils.NicknameTooLongError or utils.MessageTooLongError if nick or message
+// exceed the protocol's limits.
 // Prerequisites:
 //             * Must have previously connected and authenticated to a service
-func (oc *OpenConnection) SendContactRequest(channel int32, nick string, message string) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) SendContactRequest(channel int32, nick string, message string) error {
+	if err := checkNicknameLength(nick); err != nil {
+		return err
+	}
+	if err := checkMessageLength(message); err != nil {
+		return err
+	}
 
 	messageBuilder := new(MessageBuilder)
 	data, err := messageBuilder.OpenContactRequestChannel(channel, nick, message)
-	utils.CheckError(err)
+	if err != nil {
+		return err
+	}
 
 	oc.setChannel(channel, "im.ricochet.contact.request")
-	oc.rni.SendRicochetPacket(oc.conn, 0, data)
+	return oc.send(0, data)
 }
 
 // AckContactRequestOnResponse responds a contact request from a client
 // Prerequisites:
 //             * Must have previously connected and authenticated to a service
 //             * Must have previously received a Contact Request
-func (oc *OpenConnection) AckContactRequestOnResponse(channel int32, status string) {
-	defer utils.RecoverFromError()
-
+func (oc *OpenConnection) AckContactRequestOnResponse(channel int32, status string) error {
 	messageBuilder := new(MessageBuilder)
 	data, err := messageBuilder.ReplyToContactRequestOnResponse(channel, status)
-	utils.CheckError(err)
+	if err != nil {
+		return err
+	}
 
 	oc.setChannel(channel, "im.ricochet.contact.request")
-	oc.rni.SendRicochetPacket(oc.conn, 0, data)
+	return oc.send(0, data)
 }
 
 // AckContactRequest responds to contact request from a client
 // Prerequisites:
 //             * Must have previously connected and authenticated to a service
 //             * Must have previously received a Contact Request
-func (oc *OpenConnection) AckContactRequest(channel int32, status string) {
-	defer utils.RecoverFromError()
-
+func (oc *OpenConnection) AckContactRequest(channel int32, status string) error {
 	messageBuilder := new(MessageBuilder)
 	data, err := messageBuilder.ReplyToContactRequest(channel, status)
-	utils.CheckError(err)
+	if err != nil {
+		return err
+	}
 
 	oc.setChannel(channel, "im.ricochet.contact.request")
-	oc.rni.SendRicochetPacket(oc.conn, channel, data)
+	return oc.send(channel, data)
 }
 
 // AckChatMessage acknowledges a previously received chat message.
@@ -276,25 +697,114 @@ func (oc *OpenConnection) AckContactRequest(channel int32, status string) {
 //             * Must have previously connected and authenticated to a service
 //             * Must have established a known contact status with the other service
 //             * Must have received a Chat message on an open im.ricochet.chat channel with the messageID
-func (oc *OpenConnection) AckChatMessage(channel int32, messageID int32) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) AckChatMessage(channel int32, messageID int32) error {
+	return oc.ackChatMessage(channel, messageID, true)
+}
+
+// RejectChatMessage acknowledges a previously received chat message, telling
+// the sender that it was not accepted.
+// Prerequisites:
+//             * Must have previously connected and authenticated to a service
+//             * Must have received a Chat message on an open im.ricochet.chat channel with the messageID
+func (oc *OpenConnection) RejectChatMessage(channel int32, messageID int32) error {
+	return oc.ackChatMessage(channel, messageID, false)
+}
 
+func (oc *OpenConnection) ackChatMessage(channel int32, messageID int32, accepted bool) error {
 	messageBuilder := new(MessageBuilder)
-	data, err := messageBuilder.AckChatMessage(messageID)
-	utils.CheckError(err)
+	data, err := messageBuilder.AckChatMessage(messageID, accepted)
+	if err != nil {
+		return err
+	}
 
-	oc.rni.SendRicochetPacket(oc.conn, channel, data)
+	return oc.send(channel, data)
 }
 
-// SendMessage sends a Chat Message (message) to a give Channel (channel).
+// SendMessage sends a Chat Message (message) to a give Channel (channel),
+// returning the ID the message was sent with. The peer's acknowledgement is
+// passed to OnChatMessageAck with the same ID. Returns
+// utils.MessageTooLongError if message exceeds the protocol's limit, see
+// SendSplitMessage.
 // Prerequisites:
 //             * Must have previously connected and authenticated to a service
 //             * Must have established a known contact status with the other service
 //             * Must have previously opened channel with OpenChanel of type im.ricochet.chat
-func (oc *OpenConnection) SendMessage(channel int32, message string) {
-	defer utils.RecoverFromError()
+func (oc *OpenConnection) SendMessage(channel int32, message string) (int32, error) {
+	return oc.SendMessageAt(channel, message, time.Time{})
+}
+
+// SendMessageAt is like SendMessage, but tells the peer the message was
+// written at the given time, e.g. for messages queued while the peer was
+// offline. A zero time means now.
+// Prerequisites:
+//             * Must have previously connected and authenticated to a service
+//             * Must have established a known contact status with the other service
+//             * Must have previously opened channel with OpenChanel of type im.ricochet.chat
+func (oc *OpenConnection) SendMessageAt(channel int32, message string, written time.Time) (int32, error) {
+	if err := checkMessageLength(message); err != nil {
+		return 0, err
+	}
+	messageID := oc.nextMessageID(channel)
+	return messageID, oc.sendMessage(channel, messageID, message, written)
+}
+
+// sendMessage sends a chat message with a message ID already allocated by
+// nextMessageID.
+func (oc *OpenConnection) sendMessage(channel int32, messageID int32, message string, written time.Time) error {
+	var timeDelta int64
+	if !written.IsZero() {
+		timeDelta = int64(time.Since(written) / time.Second)
+	}
+
 	messageBuilder := new(MessageBuilder)
-	data, err := messageBuilder.ChatMessage(message, 0)
-	utils.CheckError(err)
-	oc.rni.SendRicochetPacket(oc.conn, channel, data)
+	data, err := messageBuilder.ChatMessage(message, messageID, timeDelta)
+	if err != nil {
+		return err
+	}
+	return oc.send(channel, data)
+}
+
+// SendSplitMessage is like SendMessage, but splits messages which exceed the
+// protocol's limit into as many chat messages as necessary. Returns the IDs of
+// the messages sent.
+// Prerequisites:
+//             * Must have previously connected and authenticated to a service
+//             * Must have established a known contact status with the other service
+//             * Must have previously opened channel with OpenChanel of type im.ricochet.chat
+func (oc *OpenConnection) SendSplitMessage(channel int32, message string) ([]int32, error) {
+	var messageIDs []int32
+	for _, part := range splitMessage(message) {
+		messageID, err := oc.SendMessage(channel, part)
+		if err != nil {
+			return messageIDs, err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	return messageIDs, nil
+}
+
+// SendPacket sends raw data on the given channel. It is intended for use by
+// ChannelHandlers implementing channel types beyond those built in to goricochet.
+// Prerequisites:
+//             * Must have previously opened channel
+func (oc *OpenConnection) SendPacket(channel int32, data []byte) error {
+	return oc.send(channel, data)
+}
+
+// send queues data to be written to the given channel by the writer goroutine,
+// and waits for the result. Fails if the connection has been closed.
+func (oc *OpenConnection) send(channel int32, data []byte) error {
+	packet := outboundPacket{channel, data, make(chan error, 1)}
+	select {
+	case oc.outbound <- packet:
+	case <-oc.closing:
+		return utils.ConnectionClosedError
+	}
+
+	select {
+	case err := <-packet.result:
+		return err
+	case <-oc.closing:
+		return utils.ConnectionClosedError
+	}
 }
@@ -1,7 +1,161 @@
 package goricochet
 
 import "testing"
+import "bytes"
+import "crypto"
+import "net"
+import "io"
+import "io/ioutil"
+import "github.com/golang/protobuf/proto"
+import "github.com/s-rah/go-ricochet/auth"
+import "github.com/s-rah/go-ricochet/identity"
+import "github.com/s-rah/go-ricochet/utils"
 
 func TestOpenConnectionAuth(t *testing.T) {
 
 }
+
+func TestOpenConnectionSendInvalidChannel(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	oc := new(OpenConnection)
+	oc.Init(true, conn)
+	defer oc.Close()
+
+	if _, err := oc.SendMessage(65536, "test"); err != utils.InvalidChannelIDError {
+		t.Errorf("Expected InvalidChannelIDError sending on channel 65536, got %v", err)
+	}
+}
+
+func TestOpenConnectionSendAfterClose(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	oc := new(OpenConnection)
+	oc.Init(true, conn)
+	oc.Close()
+
+	if _, err := oc.SendMessage(3, "test"); err != utils.ConnectionClosedError {
+		t.Errorf("Expected ConnectionClosedError sending on closed connection, got %v", err)
+	}
+	if err := oc.OpenChatChannel(3); err != utils.ConnectionClosedError {
+		t.Errorf("Expected ConnectionClosedError opening channel on closed connection, got %v", err)
+	}
+}
+
+func TestOpenConnectionConcurrentSend(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	oc := new(OpenConnection)
+	oc.Init(true, conn)
+	defer oc.Close()
+
+	const senders = 8
+	const messages = 16
+	for i := 0; i < senders; i++ {
+		go func(channel int32) {
+			oc.OpenChatChannel(channel)
+			for j := 0; j < messages; j++ {
+				oc.SendMessage(channel, "test")
+				oc.GetChannelType(channel)
+			}
+		}(int32(2*i + 1))
+	}
+
+	rni := new(utils.RicochetNetwork)
+	for i := 0; i < senders*(messages+1); i++ {
+		if _, err := rni.RecvRicochetPacket(peer); err != nil {
+			t.Fatalf("Error receiving packet %v: %v", i, err)
+		}
+	}
+}
+
+func TestOpenConnectionMessageIDs(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+	oc := new(OpenConnection)
+	oc.Init(true, conn)
+	defer oc.Close()
+
+	oc.OpenChatChannel(3)
+	oc.OpenChatChannel(5)
+	for _, expected := range []int32{1, 2, 3} {
+		if messageID, err := oc.SendMessage(3, "test"); err != nil || messageID != expected {
+			t.Errorf("Expected message ID %v on channel 3, got %v %v", expected, messageID, err)
+		}
+	}
+	if messageID, _ := oc.SendMessage(5, "test"); messageID != 1 {
+		t.Errorf("Expected message IDs to be allocated per channel, got %v", messageID)
+	}
+
+	oc.CloseChannel(3)
+	oc.OpenChatChannel(3)
+	if messageID, _ := oc.SendMessage(3, "test"); messageID != 1 {
+		t.Errorf("Expected message IDs to restart on a new channel, got %v", messageID)
+	}
+}
+
+// fakeSigner signs with a fixed signature, recording what it was asked to sign.
+type fakeSigner struct {
+	public crypto.PublicKey
+	digest []byte
+	opts   crypto.SignerOpts
+}
+
+func (fs *fakeSigner) Public() crypto.PublicKey {
+	return fs.public
+}
+
+func (fs *fakeSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	fs.digest = digest
+	fs.opts = opts
+	return []byte("fake signature"), nil
+}
+
+func TestOpenConnectionSendProofSigner(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	oc := new(OpenConnection)
+	oc.Init(true, conn)
+	defer oc.Close()
+	oc.SetMyHostname("kwke2hntvyfqm7dr")
+	oc.setOtherHostname("jlq67qzo6s4yp3sp")
+
+	id, err := identity.Generate(identity.V2)
+	if err != nil {
+		t.Fatalf("Could not generate identity: %v", err)
+	}
+	signer := &fakeSigner{public: id.Signer().Public()}
+
+	rni := new(utils.RicochetNetwork)
+	go oc.Authenticate(1)
+	rni.RecvRicochetPacket(peer)
+
+	other, _ := identity.Generate(identity.V2)
+	if err := oc.SendProof(1, [16]byte{}, id.PublicKey, other.Signer()); err != utils.KeyMismatchError {
+		t.Errorf("Expected KeyMismatchError signing with the wrong key, got %v", err)
+	}
+
+	go oc.SendProof(1, [16]byte{}, id.PublicKey, signer)
+	packet, err := rni.RecvRicochetPacket(peer)
+	if err != nil {
+		t.Fatalf("Error receiving proof: %v", err)
+	}
+	res := new(Protocol_Data_AuthHiddenService.Packet)
+	if err := proto.Unmarshal(packet.Data, res); err != nil {
+		t.Fatalf("Error parsing proof: %v", err)
+	}
+	if string(res.GetProof().GetSignature()) != "fake signature" || !bytes.Equal(res.GetProof().GetPublicKey(), id.Bytes()) {
+		t.Errorf("Unexpected proof %v", res.GetProof())
+	}
+	if signer.opts != crypto.SHA256 || len(signer.digest) != 32 {
+		t.Errorf("Expected the signer to be asked to sign a SHA256 sized challenge, got %v %v", signer.opts, len(signer.digest))
+	}
+
+	if oc.AuthState() != AuthAwaitingResult {
+		t.Errorf("Expected to be awaiting the result after sending a proof, got %v", oc.AuthState())
+	}
+	if err := oc.SendProof(1, [16]byte{}, id.PublicKey, signer); err != utils.AuthenticationProtocolError {
+		t.Errorf("Expected a second proof to be refused, got %v", err)
+	}
+}
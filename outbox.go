@@ -0,0 +1,361 @@
+package goricochet
+
+import (
+	"github.com/s-rah/go-ricochet/utils"
+	"sync"
+	"time"
+)
+
+// DeliveryState describes the progress of a message queued in an Outbox.
+type DeliveryState int
+
+const (
+	// MessageQueued means the message is waiting for a chat channel to the
+	// contact, or was sent on a connection which closed before it was
+	// acknowledged.
+	MessageQueued DeliveryState = iota
+	// MessageSent means the message has been sent and is awaiting
+	// acknowledgement.
+	MessageSent
+	// MessageAcked means the contact accepted the message.
+	MessageAcked
+	// MessageRejected means the contact refused the message.
+	MessageRejected
+)
+
+func (ds DeliveryState) String() string {
+	switch ds {
+	case MessageQueued:
+		return "Queued"
+	case MessageSent:
+		return "Sent"
+	case MessageAcked:
+		return "Acked"
+	case MessageRejected:
+		return "Rejected"
+	}
+	return "Unknown"
+}
+
+// OutboundMessage is a chat message queued for delivery to a contact. ID is
+// assigned by the Outbox and, unlike the protocol message ID, does not change
+// when the message is resent.
+type OutboundMessage struct {
+	ID       uint64
+	Hostname string
+	Message  string
+	State    DeliveryState
+
+	// Written is when the message was queued. It is sent with the message so
+	// the contact sees when it was written, not when it was delivered.
+	Written time.Time
+}
+
+// queuedMessage is an OutboundMessage and the details of its last send.
+type queuedMessage struct {
+	OutboundMessage
+	oc        *OpenConnection
+	channel   int32
+	messageID int32
+}
+
+// contactQueue is the outbound state kept for each contact.
+type contactQueue struct {
+	messages []*queuedMessage
+
+	// sending is held while messages are sent, so that concurrent flushes
+	// send in the order messages were claimed.
+	sending sync.Mutex
+
+	// The connection and chat channel we have opened to the contact, if any.
+	// channel is 0 while the channel is being opened.
+	oc      *OpenConnection
+	channel int32
+}
+
+// Outbox reliably delivers chat messages to contacts on behalf of a
+// StandardRicochetService. Messages are held until the contact acknowledges
+// them, and are resent whenever a new chat channel to the contact opens, so
+// they survive dropped connections. It relies on the OnOpenChannelRequestSuccess,
+// OnChatMessageAck, OnFailedChannelOpen, OnChannelClosed and OnDisconnect
+// implementations of StandardRicochetService; services overriding those
+// should call them.
+type Outbox struct {
+	srs    *StandardRicochetService
+	lock   sync.Mutex
+	lastID uint64
+	queues map[string]*contactQueue
+
+	onDeliveryStateChange func(message OutboundMessage)
+}
+
+// newOutbox creates an Outbox which delivers messages using srs.
+func newOutbox(srs *StandardRicochetService) *Outbox {
+	ob := new(Outbox)
+	ob.srs = srs
+	ob.queues = make(map[string]*contactQueue)
+	return ob
+}
+
+// SetOnDeliveryStateChange sets a function to be called whenever the state of
+// a queued message changes.
+func (ob *Outbox) SetOnDeliveryStateChange(onDeliveryStateChange func(message OutboundMessage)) {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	ob.onDeliveryStateChange = onDeliveryStateChange
+}
+
+// Queue queues a chat message for delivery to the contact with the given
+// hostname and returns its ID. If the contact is connected the message is sent
+// straight away, opening a chat channel if necessary. Returns
+// utils.MessageTooLongError if message exceeds the protocol's limit.
+func (ob *Outbox) Queue(hostname string, message string) (uint64, error) {
+	if err := checkMessageLength(message); err != nil {
+		return 0, err
+	}
+	hostname = utils.ParseOnionHostname(hostname)
+
+	ob.lock.Lock()
+	ob.lastID++
+	qm := &queuedMessage{OutboundMessage: OutboundMessage{ID: ob.lastID, Hostname: hostname, Message: message, State: MessageQueued, Written: time.Now()}}
+	cq := ob.queue(hostname)
+	cq.messages = append(cq.messages, qm)
+	queued := qm.OutboundMessage
+	ob.lock.Unlock()
+
+	ob.notify(queued)
+	if oc := ob.srs.Connection(hostname); oc != nil {
+		ob.flush(oc)
+	}
+	return qm.ID, nil
+}
+
+// Pending returns the messages to the contact which have not yet been
+// acknowledged.
+func (ob *Outbox) Pending(hostname string) []OutboundMessage {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	var pending []OutboundMessage
+	if cq, exists := ob.queues[utils.ParseOnionHostname(hostname)]; exists {
+		for _, qm := range cq.messages {
+			pending = append(pending, qm.OutboundMessage)
+		}
+	}
+	return pending
+}
+
+// peer returns the hostname the messages to the peer of oc are queued under,
+// normalised in the same way as the hostnames given to Queue.
+func peer(oc *OpenConnection) string {
+	return utils.ParseOnionHostname(oc.OtherHostname())
+}
+
+// queue returns the queue for hostname, creating it if necessary. Must be
+// called with ob.lock held.
+func (ob *Outbox) queue(hostname string) *contactQueue {
+	cq, exists := ob.queues[hostname]
+	if !exists {
+		cq = new(contactQueue)
+		ob.queues[hostname] = cq
+	}
+	return cq
+}
+
+// flush sends any unsent messages for the peer of oc, first opening a chat
+// channel if we do not have one on oc. Messages are claimed, and given their
+// message IDs, before they are sent so that concurrent flushes never send the
+// same message twice and acknowledgements can't arrive before the ID is known.
+func (ob *Outbox) flush(oc *OpenConnection) {
+	ob.lock.Lock()
+	cq, exists := ob.queues[peer(oc)]
+	if !exists || len(cq.messages) == 0 {
+		ob.lock.Unlock()
+		return
+	}
+	ob.lock.Unlock()
+
+	cq.sending.Lock()
+	defer cq.sending.Unlock()
+
+	ob.lock.Lock()
+	if cq.oc != oc || oc.IsClosed() {
+		cq.oc = oc
+		cq.channel = 0
+		ob.lock.Unlock()
+		oc.OpenChatChannel(oc.nextChannelID())
+		return
+	}
+	if cq.channel == 0 {
+		// Still waiting for the channel to open
+		ob.lock.Unlock()
+		return
+	}
+
+	// Claim the messages to send, noting those which were already sent on
+	// a channel we no longer use.
+	channel := cq.channel
+	var claims []outboxClaim
+	for _, qm := range cq.messages {
+		if qm.State == MessageQueued || qm.oc != oc || qm.channel != channel {
+			resent := qm.State == MessageSent
+			qm.oc = oc
+			qm.channel = channel
+			qm.messageID = oc.nextMessageID(channel)
+			qm.State = MessageSent
+			claims = append(claims, outboxClaim{qm, qm.messageID, resent, qm.OutboundMessage})
+		}
+	}
+	ob.lock.Unlock()
+
+	for i, claim := range claims {
+		if !claim.resent {
+			ob.notify(claim.sent)
+		}
+		if err := oc.sendMessage(channel, claim.messageID, claim.qm.Message, claim.qm.Written); err != nil {
+			ob.release(oc, claims[i:])
+			return
+		}
+	}
+}
+
+// outboxClaim is a message claimed by flush, the message ID it is to be sent
+// with and whether it had already been sent on another channel.
+type outboxClaim struct {
+	qm        *queuedMessage
+	messageID int32
+	resent    bool
+	sent      OutboundMessage
+}
+
+// release returns messages claimed by flush which could not be sent to the
+// queue, unless they have since been requeued or claimed again. The first
+// claim is the message whose send failed.
+func (ob *Outbox) release(oc *OpenConnection, claims []outboxClaim) {
+	var released []OutboundMessage
+	ob.lock.Lock()
+	for i, claim := range claims {
+		if claim.qm.State == MessageSent && claim.qm.oc == oc && claim.qm.messageID == claim.messageID {
+			claim.qm.State = MessageQueued
+			claim.qm.oc = nil
+			if i == 0 || claim.resent {
+				released = append(released, claim.qm.OutboundMessage)
+			}
+		}
+	}
+	ob.lock.Unlock()
+
+	for _, message := range released {
+		ob.notify(message)
+	}
+}
+
+// connectionAdded is called when a connection is authenticated, so that
+// pending messages to the peer can be sent.
+func (ob *Outbox) connectionAdded(oc *OpenConnection) {
+	ob.flush(oc)
+}
+
+// channelOpened is called when a channel we opened is accepted by the peer.
+func (ob *Outbox) channelOpened(oc *OpenConnection, channelID int32) {
+	if oc.GetChannelType(channelID) != "im.ricochet.chat" {
+		return
+	}
+
+	ob.lock.Lock()
+	cq := ob.queue(peer(oc))
+	cq.oc = oc
+	cq.channel = channelID
+	ob.lock.Unlock()
+
+	ob.flush(oc)
+}
+
+// channelFailed is called when a channel we opened is refused by the peer.
+func (ob *Outbox) channelFailed(oc *OpenConnection, channelID int32) {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	if cq, exists := ob.queues[peer(oc)]; exists && cq.oc == oc && cq.channel == 0 {
+		cq.oc = nil
+	}
+}
+
+// channelClosed is called when a channel on oc closes.
+func (ob *Outbox) channelClosed(oc *OpenConnection, channelID int32) {
+	ob.requeue(oc, func(channel int32) bool { return channel == channelID })
+}
+
+// connectionClosed is called when oc closes.
+func (ob *Outbox) connectionClosed(oc *OpenConnection) {
+	ob.requeue(oc, func(channel int32) bool { return true })
+}
+
+// requeue marks messages sent on the matching channels of oc which were not
+// acknowledged as queued, to be resent on the next chat channel.
+func (ob *Outbox) requeue(oc *OpenConnection, matches func(channel int32) bool) {
+	ob.lock.Lock()
+	cq, exists := ob.queues[peer(oc)]
+	if !exists {
+		ob.lock.Unlock()
+		return
+	}
+	if cq.oc == oc && matches(cq.channel) {
+		cq.oc = nil
+		cq.channel = 0
+	}
+
+	var requeued []OutboundMessage
+	for _, qm := range cq.messages {
+		if qm.State == MessageSent && qm.oc == oc && matches(qm.channel) {
+			qm.State = MessageQueued
+			requeued = append(requeued, qm.OutboundMessage)
+		}
+	}
+	ob.lock.Unlock()
+
+	for _, message := range requeued {
+		ob.notify(message)
+	}
+}
+
+// acknowledged is called when the peer acknowledges a chat message.
+func (ob *Outbox) acknowledged(oc *OpenConnection, channelID int32, messageID int32, accepted bool) {
+	ob.lock.Lock()
+	cq, exists := ob.queues[peer(oc)]
+	if !exists {
+		ob.lock.Unlock()
+		return
+	}
+
+	var acked *queuedMessage
+	for i, qm := range cq.messages {
+		if qm.State == MessageSent && qm.oc == oc && qm.channel == channelID && qm.messageID == messageID {
+			acked = qm
+			cq.messages = append(cq.messages[:i], cq.messages[i+1:]...)
+			break
+		}
+	}
+	if acked == nil {
+		ob.lock.Unlock()
+		return
+	}
+	if accepted {
+		acked.State = MessageAcked
+	} else {
+		acked.State = MessageRejected
+	}
+	message := acked.OutboundMessage
+	ob.lock.Unlock()
+
+	ob.notify(message)
+}
+
+// notify reports a change in the state of a message.
+func (ob *Outbox) notify(message OutboundMessage) {
+	ob.lock.Lock()
+	onDeliveryStateChange := ob.onDeliveryStateChange
+	ob.lock.Unlock()
+
+	if onDeliveryStateChange != nil {
+		onDeliveryStateChange(message)
+	}
+}
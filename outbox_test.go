@@ -0,0 +1,217 @@
+package goricochet
+
+import "testing"
+import "time"
+import "sync"
+import "strconv"
+import "context"
+import "runtime"
+
+type OutboxTestService struct {
+	StandardRicochetService
+	lock     sync.Mutex
+	received []string
+}
+
+func (ots *OutboxTestService) IsKnownContact(hostname string) bool {
+	return true
+}
+
+func (ots *OutboxTestService) OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string, written time.Time) {
+	ots.lock.Lock()
+	ots.received = append(ots.received, message)
+	dropped := len(ots.received) == 2
+	ots.lock.Unlock()
+
+	if dropped {
+		// Drop the connection before acknowledging the second message
+		oc.Close()
+	} else if message == "three" {
+		oc.RejectChatMessage(channelID, messageID)
+	} else {
+		oc.AckChatMessage(channelID, messageID)
+	}
+}
+
+func TestOutboxRetriesAcrossReconnects(t *testing.T) {
+	receiver := new(OutboxTestService)
+	err := receiver.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go receiver.Listen(receiver, 9912)
+
+	sender := new(OutboxTestService)
+	sender.Init("./private_key")
+	go sender.Listen(sender, 9913)
+
+	states := make(map[uint64][]DeliveryState)
+	var statesLock sync.Mutex
+	sender.Outbox().SetOnDeliveryStateChange(func(message OutboundMessage) {
+		statesLock.Lock()
+		defer statesLock.Unlock()
+		states[message.ID] = append(states[message.ID], message.State)
+	})
+
+	one, _ := sender.Outbox().Queue("kwke2hntvyfqm7dr", "one")
+	two, _ := sender.Outbox().Queue("kwke2hntvyfqm7dr", "two")
+	three, _ := sender.Outbox().Queue("kwke2hntvyfqm7dr", "three")
+
+	cm := sender.ConnectionManager()
+	cm.MinBackoff = time.Millisecond * 100
+	cm.AddPeer("127.0.0.1:9912|kwke2hntvyfqm7dr")
+	defer cm.Stop()
+
+	deadline := time.Now().Add(time.Second * 10)
+	for len(sender.Outbox().Pending("kwke2hntvyfqm7dr")) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if pending := sender.Outbox().Pending("kwke2hntvyfqm7dr"); len(pending) > 0 {
+		t.Fatalf("Expected all messages to be delivered, still pending: %v", pending)
+	}
+
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	final := func(id uint64) DeliveryState {
+		return states[id][len(states[id])-1]
+	}
+	if final(one) != MessageAcked || final(two) != MessageAcked || final(three) != MessageRejected {
+		t.Errorf("Unexpected final states: %v", states)
+	}
+
+	requeued := false
+	for i, state := range states[two] {
+		if state == MessageQueued && i > 0 && states[two][i-1] == MessageSent {
+			requeued = true
+		}
+	}
+	if !requeued {
+		t.Errorf("Expected the unacknowledged message to be requeued after the drop: %v", states[two])
+	}
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	if len(receiver.received) < 4 || receiver.received[2] != "two" {
+		t.Errorf("Expected the unacknowledged message to be resent: %v", receiver.received)
+	}
+}
+
+// OutboxCountingService counts and acknowledges the chat messages it receives.
+type OutboxCountingService struct {
+	OutboxTestService
+}
+
+func (ocs *OutboxCountingService) OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string, written time.Time) {
+	ocs.lock.Lock()
+	ocs.received = append(ocs.received, message)
+	ocs.lock.Unlock()
+	oc.AckChatMessage(channelID, messageID)
+}
+
+func TestOutboxSendsOnceWhileChannelOpens(t *testing.T) {
+	// Let the flushes run in parallel even on a single CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	receiver := new(OutboxCountingService)
+	err := receiver.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go receiver.Listen(receiver, 9937)
+
+	sender := new(OutboxTestService)
+	sender.Init("./private_key")
+	go sender.Listen(sender, 9938)
+
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := sender.ConnectContext(ctx, "127.0.0.1:9937|kwke2hntvyfqm7dr"); err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+
+	// The first message opens the chat channel. As the outbox starts sending
+	// on it the rest are queued at once, each Queue flushing concurrently
+	// with the others and with the flush of the new channel.
+	start := make(chan struct{})
+	var startOnce sync.Once
+	sender.Outbox().SetOnDeliveryStateChange(func(message OutboundMessage) {
+		if message.State == MessageSent {
+			startOnce.Do(func() { close(start) })
+		}
+	})
+	var wg sync.WaitGroup
+	for i := 1; i < 20; i++ {
+		wg.Add(1)
+		go func(message string) {
+			defer wg.Done()
+			<-start
+			sender.Outbox().Queue("kwke2hntvyfqm7dr", message)
+		}(strconv.Itoa(i))
+	}
+	sender.Outbox().Queue("kwke2hntvyfqm7dr", "0")
+
+	queued := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Chat channel was not opened")
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(sender.Outbox().Pending("kwke2hntvyfqm7dr")) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if pending := sender.Outbox().Pending("kwke2hntvyfqm7dr"); len(pending) > 0 {
+		t.Fatalf("Expected all messages to be delivered, still pending: %v", pending)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	receiver.lock.Lock()
+	defer receiver.lock.Unlock()
+	counts := make(map[string]int)
+	for _, message := range receiver.received {
+		counts[message]++
+	}
+	for i := 0; i < 20; i++ {
+		if counts[strconv.Itoa(i)] != 1 {
+			t.Errorf("Expected message %d to be received exactly once: %v", i, receiver.received)
+			break
+		}
+	}
+}
+
+func TestOutboxNormalisesHostnames(t *testing.T) {
+	receiver := new(OutboxCountingService)
+	err := receiver.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go receiver.Listen(receiver, 9943)
+
+	sender := new(OutboxTestService)
+	sender.Init("./private_key")
+	go sender.Listen(sender, 9944)
+
+	sender.Outbox().Queue("ricochet:KWKE2HNTVYFQM7DR", "one")
+	sender.Outbox().Queue("kwke2hntvyfqm7dr.onion", "two")
+
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := sender.ConnectContext(ctx, "127.0.0.1:9943|kwke2hntvyfqm7dr"); err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(sender.Outbox().Pending("KWKE2HNTVYFQM7DR")) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if pending := sender.Outbox().Pending("kwke2hntvyfqm7dr"); len(pending) > 0 {
+		t.Errorf("Expected messages queued under any form of the hostname to be delivered, still pending: %v", pending)
+	}
+}
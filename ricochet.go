@@ -1,17 +1,17 @@
 package goricochet
 
 import (
+	"context"
 	"errors"
 	"github.com/golang/protobuf/proto"
-	"github.com/s-rah/go-ricochet/auth"
-	"github.com/s-rah/go-ricochet/chat"
-	"github.com/s-rah/go-ricochet/contact"
 	"github.com/s-rah/go-ricochet/control"
 	"github.com/s-rah/go-ricochet/utils"
 	"io"
 	"log"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // Ricochet is a protocol to conducting anonymous IM.
@@ -19,6 +19,28 @@ type Ricochet struct {
 	newconns        chan *OpenConnection
 	networkResolver utils.NetworkResolver
 	rni             utils.RicochetNetworkInterface
+	handlers        map[string]ChannelHandler
+	handlersLock    sync.RWMutex
+	connections     *connectionRegistry
+
+	keepAliveInterval   time.Duration
+	maxMissedKeepAlives int
+
+	authTimeout     time.Duration
+	authGracePeriod time.Duration
+
+	// lock protects listeners, processing and shuttingDown. processing holds
+	// every connection being processed, authenticated or not, and running
+	// counts their processConnection goroutines.
+	lock         sync.Mutex
+	listeners    map[net.Listener]bool
+	processing   map[*OpenConnection]bool
+	running      sync.WaitGroup
+	shuttingDown bool
+
+	// shutdown is cancelled when Shutdown is called.
+	shutdown       context.Context
+	cancelShutdown context.CancelFunc
 }
 
 // Init sets up the Ricochet object.
@@ -26,6 +48,76 @@ func (r *Ricochet) Init() {
 	r.newconns = make(chan *OpenConnection)
 	r.networkResolver = utils.NetworkResolver{}
 	r.rni = new(utils.RicochetNetwork)
+	r.handlers = make(map[string]ChannelHandler)
+	r.connections = newConnectionRegistry()
+	r.listeners = make(map[net.Listener]bool)
+	r.processing = make(map[*OpenConnection]bool)
+	r.shutdown, r.cancelShutdown = context.WithCancel(context.Background())
+	r.authTimeout = DefaultAuthenticationTimeout
+	r.authGracePeriod = DefaultAuthenticationGracePeriod
+
+	r.RegisterChannelHandler("im.ricochet.auth.hidden-service", new(AuthChannelHandler))
+	r.RegisterChannelHandler("im.ricochet.chat", new(ChatChannelHandler))
+	r.RegisterChannelHandler("im.ricochet.contact.request", new(ContactRequestChannelHandler))
+}
+
+// RegisterChannelHandler associates a ChannelHandler with a channel type. All
+// packets for channels of that type will be passed to the handler. Registering
+// a handler for an existing type (including the built in types) replaces it.
+func (r *Ricochet) RegisterChannelHandler(channelType string, handler ChannelHandler) {
+	r.handlersLock.Lock()
+	defer r.handlersLock.Unlock()
+	r.handlers[channelType] = handler
+}
+
+// SetKeepAlive configures every new connection to send a keep alive request
+// every interval. Connections which fail to respond to maxMissed consecutive
+// requests are considered dead and closed. An interval of 0 disables keep alives.
+func (r *Ricochet) SetKeepAlive(interval time.Duration, maxMissed int) {
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+	r.keepAliveInterval = interval
+	r.maxMissedKeepAlives = maxMissed
+}
+
+// SetAuthenticationTimeouts configures how long each step of the
+// authentication handshake on new connections may take before the handshake
+// fails, and how long new connections may remain unauthenticated before they
+// are closed. A duration of 0 disables the corresponding limit.
+func (r *Ricochet) SetAuthenticationTimeouts(timeout time.Duration, gracePeriod time.Duration) {
+	r.authTimeout = timeout
+	r.authGracePeriod = gracePeriod
+}
+
+// SetNetworkResolver replaces the NetworkResolver used to connect to remote
+// services, e.g. to use a different Tor SOCKS proxy.
+func (r *Ricochet) SetNetworkResolver(networkResolver utils.NetworkResolver) {
+	r.networkResolver = networkResolver
+}
+
+// Connection returns the live, authenticated connection to the peer with the
+// given hostname, or nil if there is none.
+func (r *Ricochet) Connection(hostname string) *OpenConnection {
+	return r.connections.get(hostname)
+}
+
+// Connections returns all live, authenticated connections.
+func (r *Ricochet) Connections() []*OpenConnection {
+	return r.connections.all()
+}
+
+// CloseAll closes all live, authenticated connections.
+func (r *Ricochet) CloseAll() {
+	r.connections.closeAll()
+}
+
+// channelHandler returns the ChannelHandler registered for channelType, if any.
+func (r *Ricochet) channelHandler(channelType string) (ChannelHandler, bool) {
+	r.handlersLock.RLock()
+	defer r.handlersLock.RUnlock()
+	handler, ok := r.handlers[channelType]
+	return handler, ok
 }
 
 // Connect sets up a client ricochet connection to host e.g. qn6uo4cmsrfv4kzq.onion. If this
@@ -33,42 +125,81 @@ func (r *Ricochet) Init() {
 // be open and authenticated.
 // To specify a local port using the format "127.0.0.1:[port]|ricochet-id".
 func (r *Ricochet) Connect(host string) (*OpenConnection, error) {
+	return r.ConnectContext(context.Background(), host)
+}
+
+// ConnectContext is like Connect, but gives up dialing and version negotiation
+// if ctx is cancelled or expires first.
+func (r *Ricochet) ConnectContext(ctx context.Context, host string) (*OpenConnection, error) {
 	var err error
-	conn, host, err := r.networkResolver.Resolve(host)
+	conn, host, err := r.networkResolver.ResolveContext(ctx, host)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return r.ConnectOpen(conn, host)
+	return r.ConnectOpenContext(ctx, conn, host)
 }
 
 // ConnectOpen attempts to open up a new connection to the given host. Returns a
 // pointer to the OpenConnection or an error.
 func (r *Ricochet) ConnectOpen(conn net.Conn, host string) (*OpenConnection, error) {
-	oc, err := r.negotiateVersion(conn, true)
+	return r.ConnectOpenContext(context.Background(), conn, host)
+}
+
+// ConnectOpenContext is like ConnectOpen, but gives up version negotiation if
+// ctx is cancelled or expires first. The connection is closed on failure.
+func (r *Ricochet) ConnectOpenContext(ctx context.Context, conn net.Conn, host string) (*OpenConnection, error) {
+	oc, err := r.negotiateVersionContext(ctx, conn, true)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	oc.OtherHostname = host
-	r.newconns <- oc
-	return oc, nil
+	oc.setOtherHostname(host)
+	oc.dialledHostname = oc.OtherHostname()
+
+	select {
+	case r.newconns <- oc:
+		return oc, nil
+	case <-ctx.Done():
+		oc.Close()
+		return nil, ctx.Err()
+	case <-r.shutdown.Done():
+		oc.Close()
+		return nil, utils.ShutdownError
+	}
 }
 
-// Server launches a new server listening on port
-func (r *Ricochet) Server(service RicochetService, port int) {
+// Server launches a new server listening on 127.0.0.1:port. It blocks until
+// the server is shut down, and returns an error if it could not listen.
+func (r *Ricochet) Server(service RicochetService, port int) error {
 	ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
 	if err != nil {
-		log.Printf("Cannot Listen on Port %v", port)
-		return
+		return err
 	}
 
 	r.ServeListener(service, ln)
+	return nil
 }
 
 // ServeListener processes all messages given by the listener ln with the given
-// RicochetService, service.
+// RicochetService, service. It returns once ln is closed, e.g. by Shutdown.
 func (r *Ricochet) ServeListener(service RicochetService, ln net.Listener) {
+	r.lock.Lock()
+	if r.shuttingDown {
+		r.lock.Unlock()
+		ln.Close()
+		return
+	}
+	r.listeners[ln] = true
+	r.lock.Unlock()
+
+	defer func() {
+		r.lock.Lock()
+		delete(r.listeners, ln)
+		r.lock.Unlock()
+	}()
+
 	go r.ProcessMessages(service)
 	service.OnReady()
 	for {
@@ -83,10 +214,16 @@ func (r *Ricochet) ServeListener(service RicochetService, ln net.Listener) {
 
 // processNewConnection sets up a new connection
 func (r *Ricochet) processNewConnection(conn net.Conn, service RicochetService) {
-	oc, err := r.negotiateVersion(conn, false)
-	if err == nil {
-		r.newconns <- oc
-		service.OnConnect(oc)
+	oc, err := r.negotiateVersionContext(r.shutdown, conn, false)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case r.newconns <- oc:
+	case <-r.shutdown.Done():
+		oc.Close()
 	}
 }
 
@@ -96,29 +233,116 @@ func (r *Ricochet) processNewConnection(conn net.Conn, service RicochetService)
 //             * Must have previously issued a successful Connect()
 func (r *Ricochet) ProcessMessages(service RicochetService) {
 	for {
-		oc := <-r.newconns
-		if oc == nil {
+		select {
+		case oc := <-r.newconns:
+			if oc == nil {
+				return
+			}
+			r.lock.Lock()
+			if r.shuttingDown {
+				r.lock.Unlock()
+				oc.Close()
+				continue
+			}
+			r.processing[oc] = true
+			r.running.Add(1)
+			r.lock.Unlock()
+
+			go func() {
+				defer r.running.Done()
+				r.processConnection(oc, service)
+
+				r.lock.Lock()
+				delete(r.processing, oc)
+				r.lock.Unlock()
+			}()
+		case <-r.shutdown.Done():
 			return
 		}
-		go r.processConnection(oc, service)
 	}
 }
 
 // RequestStopMessageLoop requests that the ProcessMessages loop is stopped after handling all currently
 // queued new connections.
 func (r *Ricochet) RequestStopMessageLoop() {
-	r.newconns <- nil
+	select {
+	case r.newconns <- nil:
+	case <-r.shutdown.Done():
+	}
+}
+
+// Shutdown gracefully shuts down the Ricochet instance. It closes all
+// listeners passed to ServeListener, stops the ProcessMessages loop, closes the
+// open channels of every connection and then closes our side of each
+// connection for writing. Shutdown then waits for peers to close their side and
+// for every connection to finish processing. If ctx is done first, the
+// remaining connections are closed immediately and ctx.Err() is returned.
+//
+// Once Shutdown has been called, no new connections can be made.
+func (r *Ricochet) Shutdown(ctx context.Context) error {
+	r.lock.Lock()
+	r.shuttingDown = true
+	r.cancelShutdown()
+	for ln := range r.listeners {
+		ln.Close()
+	}
+	r.lock.Unlock()
+
+	for _, oc := range r.processingConnections() {
+		go oc.closeGracefully()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, oc := range r.processingConnections() {
+			oc.Close()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+// processingConnections returns a snapshot of all connections being processed.
+func (r *Ricochet) processingConnections() []*OpenConnection {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	connections := make([]*OpenConnection, 0, len(r.processing))
+	for oc := range r.processing {
+		connections = append(connections, oc)
+	}
+	return connections
 }
 
 // ProcessConnection starts a blocking process loop which continually waits for
 // new messages to arrive from the connection and uses the given RicochetService
 // to process them.
 func (r *Ricochet) processConnection(oc *OpenConnection, service RicochetService) {
+	oc.lock.Lock()
+	oc.registry = r.connections
+	oc.lock.Unlock()
+	defer r.connections.remove(oc)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchAuthentication(oc, service, r.authTimeout, r.authGracePeriod, stop)
+
 	service.OnConnect(oc)
 	defer service.OnDisconnect(oc)
 
+	if r.keepAliveInterval > 0 {
+		go r.keepAlive(oc, stop)
+	}
+
 	for {
-		if oc.Closed {
+		if oc.IsClosed() {
 			return
 		}
 
@@ -129,213 +353,142 @@ func (r *Ricochet) processConnection(oc *OpenConnection, service RicochetService
 		}
 
 		if len(packet.Data) == 0 {
+			if handler, ok := r.channelHandler(oc.GetChannelType(packet.Channel)); ok {
+				handler.OnChannelClosed(oc, service, packet.Channel)
+			}
 			service.OnChannelClosed(oc, packet.Channel)
 			continue
 		}
 
 		if packet.Channel == 0 {
+			r.processControlPacket(oc, service, packet)
+		} else if oc.GetChannelType(packet.Channel) == "none" {
+			// Invalid Channel Assignment
+			oc.CloseChannel(packet.Channel)
+		} else if handler, ok := r.channelHandler(oc.GetChannelType(packet.Channel)); ok {
+			handler.OnPacket(oc, service, packet.Channel, packet.Data)
+		} else {
+			oc.Close()
+		}
+	}
+}
 
-			res := new(Protocol_Data_Control.Packet)
-			err := proto.Unmarshal(packet.Data[:], res)
+// processControlPacket handles a single packet received on the control channel
+func (r *Ricochet) processControlPacket(oc *OpenConnection, service RicochetService, packet utils.RicochetData) {
+	res := new(Protocol_Data_Control.Packet)
+	err := proto.Unmarshal(packet.Data[:], res)
 
-			if err != nil {
-				service.OnGenericError(oc, packet.Channel)
-				continue
-			}
+	if err != nil {
+		service.OnGenericError(oc, packet.Channel)
+		return
+	}
 
-			if res.GetOpenChannel() != nil {
-				opm := res.GetOpenChannel()
-
-				if oc.GetChannelType(opm.GetChannelIdentifier()) != "none" {
-					// Channel is already in use.
-					service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					continue
-				}
-
-				// If I am a Client, the server can only open even numbered channels
-				if oc.Client && opm.GetChannelIdentifier()%2 != 0 {
-					service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					continue
-				}
-
-				// If I am a Server, the client can only open odd numbered channels
-				if !oc.Client && opm.GetChannelIdentifier()%2 != 1 {
-					service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					continue
-				}
-
-				switch opm.GetChannelType() {
-				case "im.ricochet.auth.hidden-service":
-					if oc.Client {
-						// Servers are authed by default and can't auth with hidden-service
-						service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					} else if oc.IsAuthed {
-						// Can't auth if already authed
-						service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					} else if oc.HasChannel("im.ricochet.auth.hidden-service") {
-						// Can't open more than 1 auth channel
-						service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					} else {
-						clientCookie, err := proto.GetExtension(opm, Protocol_Data_AuthHiddenService.E_ClientCookie)
-						if err == nil {
-							clientCookieB := [16]byte{}
-							copy(clientCookieB[:], clientCookie.([]byte)[:])
-							service.OnAuthenticationRequest(oc, opm.GetChannelIdentifier(), clientCookieB)
-						} else {
-							// Must include Client Cookie
-							service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-						}
-					}
-				case "im.ricochet.chat":
-					if !oc.IsAuthed {
-						// Can't open chat channel if not authorized
-						service.OnUnauthorizedError(oc, opm.GetChannelIdentifier())
-					} else if !service.IsKnownContact(oc.OtherHostname) {
-						// Can't open chat channel if not a known contact
-						service.OnUnauthorizedError(oc, opm.GetChannelIdentifier())
-					} else {
-						service.OnOpenChannelRequest(oc, opm.GetChannelIdentifier(), "im.ricochet.chat")
-					}
-				case "im.ricochet.contact.request":
-					if oc.Client {
-						// Servers are not allowed to send contact requests
-						service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					} else if !oc.IsAuthed {
-						// Can't open a contact channel if not authed
-						service.OnUnauthorizedError(oc, opm.GetChannelIdentifier())
-					} else if oc.HasChannel("im.ricochet.contact.request") {
-						// Only 1 contact channel is allowed to be open at a time
-						service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					} else {
-						contactRequestI, err := proto.GetExtension(opm, Protocol_Data_ContactRequest.E_ContactRequest)
-						if err == nil {
-							contactRequest, check := contactRequestI.(*Protocol_Data_ContactRequest.ContactRequest)
-							if check {
-								service.OnContactRequest(oc, opm.GetChannelIdentifier(), contactRequest.GetNickname(), contactRequest.GetMessageText())
-								break
-							}
-						}
-						service.OnBadUsageError(oc, opm.GetChannelIdentifier())
-					}
-				default:
-					service.OnUnknownTypeError(oc, opm.GetChannelIdentifier())
-				}
-			} else if res.GetChannelResult() != nil {
-				crm := res.GetChannelResult()
-				if crm.GetOpened() {
-					switch oc.GetChannelType(crm.GetChannelIdentifier()) {
-					case "im.ricochet.auth.hidden-service":
-						serverCookie, err := proto.GetExtension(crm, Protocol_Data_AuthHiddenService.E_ServerCookie)
-						if err == nil {
-							serverCookieB := [16]byte{}
-							copy(serverCookieB[:], serverCookie.([]byte)[:])
-							service.OnAuthenticationChallenge(oc, crm.GetChannelIdentifier(), serverCookieB)
-						} else {
-							service.OnBadUsageError(oc, crm.GetChannelIdentifier())
-						}
-					case "im.ricochet.chat":
-						service.OnOpenChannelRequestSuccess(oc, crm.GetChannelIdentifier())
-					case "im.ricochet.contact.request":
-						responseI, err := proto.GetExtension(res.GetChannelResult(), Protocol_Data_ContactRequest.E_Response)
-						if err == nil {
-							response, check := responseI.(*Protocol_Data_ContactRequest.Response)
-							if check {
-								service.OnContactRequestAck(oc, crm.GetChannelIdentifier(), response.GetStatus().String())
-								break
-							}
-						}
-						service.OnBadUsageError(oc, crm.GetChannelIdentifier())
-					default:
-						service.OnBadUsageError(oc, crm.GetChannelIdentifier())
-					}
-				} else {
-					if oc.GetChannelType(crm.GetChannelIdentifier()) != "none" {
-						service.OnFailedChannelOpen(oc, crm.GetChannelIdentifier(), crm.GetCommonError().String())
-					} else {
-						oc.CloseChannel(crm.GetChannelIdentifier())
-					}
-				}
-			} else {
-				// Unknown Message
-				oc.CloseChannel(packet.Channel)
-			}
-		} else if oc.GetChannelType(packet.Channel) == "im.ricochet.auth.hidden-service" {
-			res := new(Protocol_Data_AuthHiddenService.Packet)
-			err := proto.Unmarshal(packet.Data[:], res)
+	if res.GetOpenChannel() != nil {
+		opm := res.GetOpenChannel()
 
-			if err != nil {
-				oc.CloseChannel(packet.Channel)
-				continue
-			}
+		if oc.GetChannelType(opm.GetChannelIdentifier()) != "none" {
+			// Channel is already in use.
+			service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+			return
+		}
 
-			if res.GetProof() != nil && !oc.Client { // Only Clients Send Proofs
-				service.OnAuthenticationProof(oc, packet.Channel, res.GetProof().GetPublicKey(), res.GetProof().GetSignature(), service.IsKnownContact(oc.OtherHostname))
-			} else if res.GetResult() != nil && oc.Client { // Only Servers Send Results
-				service.OnAuthenticationResult(oc, packet.Channel, res.GetResult().GetAccepted(), res.GetResult().GetIsKnownContact())
-			} else {
-				// If neither of the above are satisfied we just close the connection
-				oc.Close()
-			}
+		// If I am a Client, the server can only open even numbered channels
+		if oc.Client && opm.GetChannelIdentifier()%2 != 0 {
+			service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+			return
+		}
+
+		// If I am a Server, the client can only open odd numbered channels
+		if !oc.Client && opm.GetChannelIdentifier()%2 != 1 {
+			service.OnBadUsageError(oc, opm.GetChannelIdentifier())
+			return
+		}
 
-		} else if oc.GetChannelType(packet.Channel) == "im.ricochet.chat" {
-
-			// NOTE: These auth checks should be redundant, however they
-			// are included here for defense-in-depth if for some reason
-			// a previously authed connection becomes untrusted / not known and
-			// the state is not cleaned up.
-			if !oc.IsAuthed {
-				// Can't send chat messages if not authorized
-				service.OnUnauthorizedError(oc, packet.Channel)
-			} else if !service.IsKnownContact(oc.OtherHostname) {
-				// Can't send chat message if not a known contact
-				service.OnUnauthorizedError(oc, packet.Channel)
+		if handler, ok := r.channelHandler(opm.GetChannelType()); ok {
+			handler.OnOpenChannelRequest(oc, service, opm)
+		} else {
+			service.OnUnknownTypeError(oc, opm.GetChannelIdentifier())
+		}
+	} else if res.GetKeepAlive() != nil {
+		if res.GetKeepAlive().GetResponseRequested() {
+			oc.SendKeepAlive(false)
+		} else {
+			oc.keepAliveReceived()
+		}
+	} else if res.GetEnableFeatures() != nil {
+		service.OnEnableFeatures(oc, res.GetEnableFeatures().GetFeature())
+	} else if res.GetFeaturesEnabled() != nil {
+		service.OnFeaturesEnabled(oc, oc.setFeaturesEnabled(res.GetFeaturesEnabled().GetFeature()))
+	} else if res.GetChannelResult() != nil {
+		crm := res.GetChannelResult()
+		if crm.GetOpened() {
+			if handler, ok := r.channelHandler(oc.GetChannelType(crm.GetChannelIdentifier())); ok {
+				handler.OnOpenChannelResult(oc, service, crm)
 			} else {
-				res := new(Protocol_Data_Chat.Packet)
-				err := proto.Unmarshal(packet.Data[:], res)
-
-				if err != nil {
-					oc.CloseChannel(packet.Channel)
-					continue
-				}
-
-				if res.GetChatMessage() != nil {
-					service.OnChatMessage(oc, packet.Channel, int32(res.GetChatMessage().GetMessageId()), res.GetChatMessage().GetMessageText())
-				} else if res.GetChatAcknowledge() != nil {
-					service.OnChatMessageAck(oc, packet.Channel, int32(res.GetChatMessage().GetMessageId()))
-				} else {
-					// If neither of the above are satisfied we just close the connection
-					oc.Close()
-				}
+				service.OnBadUsageError(oc, crm.GetChannelIdentifier())
 			}
-		} else if oc.GetChannelType(packet.Channel) == "im.ricochet.contact.request" {
-
-			// NOTE: These auth checks should be redundant, however they
-			// are included here for defense-in-depth if for some reason
-			// a previously authed connection becomes untrusted / not known and
-			// the state is not cleaned up.
-			if !oc.Client {
-				// Clients are not allowed to send contact request responses
-				service.OnBadUsageError(oc, packet.Channel)
-			} else if !oc.IsAuthed {
-				// Can't send a contact request if not authed
-				service.OnBadUsageError(oc, packet.Channel)
+		} else {
+			if oc.GetChannelType(crm.GetChannelIdentifier()) != "none" {
+				service.OnFailedChannelOpen(oc, crm.GetChannelIdentifier(), crm.GetCommonError().String())
 			} else {
-				res := new(Protocol_Data_ContactRequest.Response)
-				err := proto.Unmarshal(packet.Data[:], res)
-				log.Printf("%v", res)
-				if err != nil {
-					oc.CloseChannel(packet.Channel)
-					continue
-				}
-				service.OnContactRequestAck(oc, packet.Channel, res.GetStatus().String())
+				oc.CloseChannel(crm.GetChannelIdentifier())
 			}
-		} else if oc.GetChannelType(packet.Channel) == "none" {
-			// Invalid Channel Assignment
-			oc.CloseChannel(packet.Channel)
-		} else {
+		}
+	} else {
+		// Unknown Message
+		oc.CloseChannel(packet.Channel)
+	}
+}
+
+// keepAlive periodically sends keep alive requests on the connection until stop
+// is closed, closing the connection if the peer stops responding.
+func (r *Ricochet) keepAlive(oc *OpenConnection, stop chan struct{}) {
+	ticker := time.NewTicker(r.keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if oc.missedKeepAlives() >= r.maxMissedKeepAlives {
+				log.Printf("Closing connection: missed %d keep alives", oc.missedKeepAlives())
+				oc.Close()
+				return
+			}
+			oc.SendKeepAlive(true)
+		}
+	}
+}
+
+// negotiateVersionContext performs version negotiation, aborting it if ctx is
+// done first, in which case ctx.Err() is returned.
+func (r *Ricochet) negotiateVersionContext(ctx context.Context, conn net.Conn, outbound bool) (*OpenConnection, error) {
+	stop := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock any pending read or write
+			conn.SetDeadline(time.Now())
+			aborted <- true
+		case <-stop:
+			aborted <- false
+		}
+	}()
+
+	oc, err := r.negotiateVersion(conn, outbound)
+	close(stop)
+
+	if <-aborted || (err != nil && ctx.Err() != nil) {
+		if oc != nil {
 			oc.Close()
 		}
+		return nil, ctx.Err()
 	}
+
+	conn.SetDeadline(time.Time{})
+	return oc, err
 }
 
 // Perform version negotiation on the connection, and create an OpenConnection if successful
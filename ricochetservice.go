@@ -1,16 +1,32 @@
 package goricochet
 
+import (
+	"time"
+)
+
 // RicochetService provides an interface for building automated ricochet applications.
 type RicochetService interface {
 	OnReady()
 	OnConnect(oc *OpenConnection)
 	OnDisconnect(oc *OpenConnection)
 
+	// Feature Negotiation
+	OnEnableFeatures(oc *OpenConnection, features []string)
+	OnFeaturesEnabled(oc *OpenConnection, features []string)
+
 	// Authentication Management
 	OnAuthenticationRequest(oc *OpenConnection, channelID int32, clientCookie [16]byte)
 	OnAuthenticationChallenge(oc *OpenConnection, channelID int32, serverCookie [16]byte)
-	OnAuthenticationProof(oc *OpenConnection, channelID int32, publicKey []byte, signature []byte, isKnownContact bool)
+	// OnAuthenticationProof is called when a client sends its proof. Whether
+	// the client is a known contact can only be decided once the proof is
+	// validated and its hostname established.
+	OnAuthenticationProof(oc *OpenConnection, channelID int32, publicKey []byte, signature []byte)
 	OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool)
+	// OnAuthenticationFailed is called when the authentication handshake
+	// fails, just before the connection is closed. reason is one of
+	// utils.AuthenticationRejectedError, utils.AuthenticationProtocolError,
+	// utils.AuthenticationTimeoutError or utils.AuthenticationGracePeriodError.
+	OnAuthenticationFailed(oc *OpenConnection, reason error)
 
 	// Contact Management
 	IsKnownContact(hostname string) bool
@@ -23,8 +39,10 @@ type RicochetService interface {
 	OnChannelClosed(oc *OpenConnection, channelID int32)
 
 	// Chat Messages
-	OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string)
-	OnChatMessageAck(oc *OpenConnection, channelID int32, messageID int32)
+	// written is when the sender says the message was written, which may be
+	// some time ago if the message was queued while we were offline.
+	OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string, written time.Time)
+	OnChatMessageAck(oc *OpenConnection, channelID int32, messageID int32, accepted bool)
 
 	// Handle Errors
 	OnFailedChannelOpen(oc *OpenConnection, channelID int32, errorType string)
@@ -33,4 +51,10 @@ type RicochetService interface {
 	OnUnauthorizedError(oc *OpenConnection, channelID int32)
 	OnBadUsageError(oc *OpenConnection, channelID int32)
 	OnFailedError(oc *OpenConnection, channelID int32)
+
+	// OnLimitExceeded is called when the peer sends a nickname or message
+	// which exceeds the protocol's limits, with utils.NicknameTooLongError or
+	// utils.MessageTooLongError. The offending contact request or chat message
+	// has already been rejected.
+	OnLimitExceeded(oc *OpenConnection, channelID int32, err error)
 }
@@ -0,0 +1,93 @@
+package goricochet
+
+import "testing"
+import "time"
+import "net"
+import "io"
+import "io/ioutil"
+import "context"
+
+func TestShutdown(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	listening := make(chan struct{})
+	go func() {
+		ricochetService.Listen(ricochetService, 9906)
+		close(listening)
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(StandardRicochetService)
+	ricochetService2.Init("./private_key")
+	go ricochetService2.Listen(ricochetService2, 9907)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	oc, err := ricochetService2.ConnectContext(ctx, "127.0.0.1:9906|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Fatalf("Could not connect to ricochet service: %v", err)
+	}
+
+	err = ricochetService.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Expected a graceful shutdown, got %v", err)
+	}
+
+	select {
+	case <-listening:
+	case <-time.After(time.Second):
+		t.Errorf("Listen did not return after Shutdown")
+	}
+
+	select {
+	case <-oc.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Expected the peer to see the connection close")
+	}
+
+	if _, err := net.Dial("tcp", "127.0.0.1:9906"); err == nil {
+		t.Errorf("Expected the listener to be closed")
+	}
+
+	if _, err := ricochetService.Connect("127.0.0.1:9907|kwke2hntvyfqm7dr"); err == nil {
+		t.Errorf("Expected Connect to fail after Shutdown")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9908)
+
+	time.Sleep(time.Millisecond * 100)
+
+	// A peer which negotiates a version and then never closes its side
+	conn, err := net.Dial("tcp", "127.0.0.1:9908")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x49, 0x4D, 0x01, 0x01})
+	io.ReadFull(conn, make([]byte, 1))
+	go io.Copy(ioutil.Discard, conn)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	start := time.Now()
+	err = ricochetService.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to hit the deadline, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Shutdown did not force close connections at the deadline")
+	}
+}
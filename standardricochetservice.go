@@ -1,91 +1,433 @@
 package goricochet
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/asn1"
-	"encoding/pem"
+	"context"
 	"errors"
+	"github.com/s-rah/go-ricochet/identity"
 	"github.com/s-rah/go-ricochet/utils"
-	"io/ioutil"
+	"github.com/s-rah/go-ricochet/utils/torcontrol"
 	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // StandardRicochetService implements all the necessary flows to implement a
 // minimal, protocol compliant Ricochet Service. It can be built on by other
 // applications to produce automated riochet applications.
 type StandardRicochetService struct {
-	ricochet       *Ricochet
-	privateKey     *rsa.PrivateKey
-	serverHostname string
+	ricochet          *Ricochet
+	identity          *identity.Identity
+	serverHostname    string
+	features          []string
+	torControl        *torcontrol.Conn
+	connectionManager *ConnectionManager
+	outbox            *Outbox
+	contacts          ContactStore
+	contactPolicy     ContactRequestPolicy
+
+	// lock protects pendingRequests, the channels of contact requests
+	// awaiting ApproveContact or RejectContact, by hostname.
+	lock            sync.Mutex
+	pendingRequests map[string]pendingContactRequest
+}
+
+// pendingContactRequest identifies the channel of a contact request which is
+// awaiting a decision.
+type pendingContactRequest struct {
+	oc        *OpenConnection
+	channelID int32
 }
 
 // Init initializes a StandardRicochetService with the cryptographic key given
-// by filename.
+// by filename: either a PKCS1 "RSA PRIVATE KEY" (a v2 onion service) or a
+// PKCS8 "PRIVATE KEY" holding an RSA or Ed25519 (v3 onion service) key.
 func (srs *StandardRicochetService) Init(filename string) error {
+	id, err := identity.LoadFile(filename)
+	if err != nil {
+		return err
+	}
+	return srs.InitWithIdentity(id)
+}
+
+// InitWithIdentity initializes a StandardRicochetService with an identity
+// generated or loaded through the identity package.
+func (srs *StandardRicochetService) InitWithIdentity(id *identity.Identity) error {
+	if id == nil {
+		return utils.KeyNotFoundError
+	}
 	srs.ricochet = new(Ricochet)
 	srs.ricochet.Init()
+	srs.connectionManager = newConnectionManager(srs)
+	srs.outbox = newOutbox(srs)
+	srs.contacts = NewMemoryContactStore()
+	srs.contactPolicy = ReviewContactRequests
+	srs.pendingRequests = make(map[string]pendingContactRequest)
+	srs.ricochet.connections.added = srs.connectionAdded
+
+	srs.identity = id
+	srs.serverHostname = srs.identity.Hostname()
+	log.Printf("Initialised ricochet service for %s", srs.serverHostname)
 
-	pemData, err := ioutil.ReadFile(filename)
+	return nil
+}
 
-	if err != nil {
-		return errors.New("Could not setup ricochet service: could not read private key")
+// Identity returns the key the service is identified by. Must be called after
+// Init.
+func (srs *StandardRicochetService) Identity() *identity.Identity {
+	return srs.identity
+}
+
+// RegisterChannelHandler adds support for a new channel type to the service, or
+// replaces the handler of a built in type. Must be called after Init.
+func (srs *StandardRicochetService) RegisterChannelHandler(channelType string, handler ChannelHandler) {
+	srs.ricochet.RegisterChannelHandler(channelType, handler)
+}
+
+// SetKeepAlive configures the interval at which keep alives are sent on every
+// connection, and how many may go unanswered before the connection is closed.
+// Must be called after Init.
+func (srs *StandardRicochetService) SetKeepAlive(interval time.Duration, maxMissed int) {
+	srs.ricochet.SetKeepAlive(interval, maxMissed)
+}
+
+// SetAuthenticationTimeouts configures how long each step of the
+// authentication handshake may take, and how long connections may remain
+// unauthenticated before they are closed. Must be called after Init.
+func (srs *StandardRicochetService) SetAuthenticationTimeouts(timeout time.Duration, gracePeriod time.Duration) {
+	srs.ricochet.SetAuthenticationTimeouts(timeout, gracePeriod)
+}
+
+// SetNetworkResolver configures how the service connects to remote services,
+// e.g. which Tor SOCKS proxy to use. Must be called after Init.
+func (srs *StandardRicochetService) SetNetworkResolver(networkResolver utils.NetworkResolver) {
+	srs.ricochet.SetNetworkResolver(networkResolver)
+}
+
+// OnReady is called once a Server has been established (by calling Listen)
+func (srs *StandardRicochetService) OnReady() {
+}
+
+// ConnectionManager returns the manager which maintains connections to the
+// service's desired peers. Must be called after Init.
+func (srs *StandardRicochetService) ConnectionManager() *ConnectionManager {
+	return srs.connectionManager
+}
+
+// SetContactStore replaces the store used to keep track of contacts, e.g. with
+// a FileContactStore to persist them. Must be called after Init.
+func (srs *StandardRicochetService) SetContactStore(contacts ContactStore) {
+	srs.contacts = contacts
+}
+
+// ContactStore returns the store used to keep track of contacts.
+func (srs *StandardRicochetService) ContactStore() ContactStore {
+	return srs.contacts
+}
+
+// AddContact adds the peer with the given hostname as an accepted contact,
+// or marks an existing contact as accepted.
+func (srs *StandardRicochetService) AddContact(hostname string, nickname string) error {
+	contact, exists := srs.contacts.GetContact(hostname)
+	if !exists {
+		contact = Contact{Hostname: hostname}
+	}
+	if nickname != "" {
+		contact.Nickname = nickname
 	}
+	contact.Status = ContactAccepted
+	return srs.contacts.SaveContact(contact)
+}
+
+// RemoveContact removes the peer with the given hostname from our contacts.
+func (srs *StandardRicochetService) RemoveContact(hostname string) error {
+	return srs.contacts.RemoveContact(hostname)
+}
 
-	block, _ := pem.Decode(pemData)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		return errors.New("Could not setup ricochet service: no valid PEM data found")
+// BlockContact blocks the peer with the given hostname. Blocked peers fail
+// authentication, cannot be connected to and have their contact requests
+// rejected. Any connection to the peer is closed. The block is kept in the
+// ContactStore.
+func (srs *StandardRicochetService) BlockContact(hostname string) error {
+	hostname = utils.ParseOnionHostname(hostname)
+	if err := srs.setBlocked(hostname, true); err != nil {
+		return err
+	}
+	srs.connectionManager.RemovePeer(hostname)
+	if oc := srs.Connection(hostname); oc != nil {
+		oc.Close()
 	}
+	return nil
+}
 
-	srs.privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return errors.New("Could not setup ricochet service: could not parse private key")
+// UnblockContact removes the block on the peer with the given hostname.
+func (srs *StandardRicochetService) UnblockContact(hostname string) error {
+	return srs.setBlocked(utils.ParseOnionHostname(hostname), false)
+}
+
+// IsBlocked returns true if the peer with the given hostname is blocked. The
+// hostname may be in any form accepted by utils.ParseOnionHostname.
+func (srs *StandardRicochetService) IsBlocked(hostname string) bool {
+	contact, exists := srs.contacts.GetContact(utils.ParseOnionHostname(hostname))
+	return exists && contact.Blocked
+}
+
+// setBlocked updates the blocked flag of a contact, adding a contact with no
+// request status if necessary.
+func (srs *StandardRicochetService) setBlocked(hostname string, blocked bool) error {
+	contact, exists := srs.contacts.GetContact(hostname)
+	if !exists {
+		if !blocked {
+			return nil
+		}
+		contact = Contact{Hostname: hostname, Status: ContactRejected}
+	}
+	contact.Blocked = blocked
+	return srs.contacts.SaveContact(contact)
+}
+
+// SetContactRequestPolicy sets the policy used to answer inbound contact
+// requests. The default policy, ReviewContactRequests, leaves every request
+// pending until ApproveContact or RejectContact is called. Must be called
+// after Init.
+func (srs *StandardRicochetService) SetContactRequestPolicy(policy ContactRequestPolicy) {
+	srs.contactPolicy = policy
+}
+
+// PendingContactRequests returns the contacts whose requests are awaiting a
+// decision.
+func (srs *StandardRicochetService) PendingContactRequests() []Contact {
+	var pending []Contact
+	for _, contact := range srs.contacts.Contacts() {
+		if contact.Status == ContactPending {
+			pending = append(pending, contact)
+		}
 	}
+	return pending
+}
 
-	publicKeyBytes, _ := asn1.Marshal(rsa.PublicKey{
-		N: srs.privateKey.PublicKey.N,
-		E: srs.privateKey.PublicKey.E,
-	})
+// ApproveContact accepts the contact request from the peer with the given
+// hostname. If the peer is still waiting on the request's channel they are
+// told straight away.
+func (srs *StandardRicochetService) ApproveContact(hostname string) error {
+	return srs.decideContactRequest(hostname, ContactAccepted)
+}
 
-	srs.serverHostname = utils.GetTorHostname(publicKeyBytes)
-	log.Printf("Initialised ricochet service for %s", srs.serverHostname)
+// RejectContact rejects the contact request from the peer with the given
+// hostname. If the peer is still waiting on the request's channel they are
+// told straight away.
+func (srs *StandardRicochetService) RejectContact(hostname string) error {
+	return srs.decideContactRequest(hostname, ContactRejected)
+}
 
+// decideContactRequest records the decision on a pending contact request and
+// sends it to the peer if the request's channel is still open.
+func (srs *StandardRicochetService) decideContactRequest(hostname string, status ContactStatus) error {
+	hostname = utils.ParseOnionHostname(hostname)
+	contact, exists := srs.contacts.GetContact(hostname)
+	if !exists {
+		contact = Contact{Hostname: hostname}
+	}
+	contact.Status = status
+	if err := srs.contacts.SaveContact(contact); err != nil {
+		return err
+	}
+
+	srs.lock.Lock()
+	pending, exists := srs.pendingRequests[hostname]
+	delete(srs.pendingRequests, hostname)
+	srs.lock.Unlock()
+
+	if exists && !pending.oc.IsClosed() && pending.oc.GetChannelType(pending.channelID) == "im.ricochet.contact.request" {
+		pending.oc.AckContactRequest(pending.channelID, status.String())
+		pending.oc.CloseChannel(pending.channelID)
+	}
 	return nil
 }
 
-// OnReady is called once a Server has been established (by calling Listen)
-func (srs *StandardRicochetService) OnReady() {
+// Outbox returns the queue used to reliably deliver chat messages to contacts.
+// Must be called after Init.
+func (srs *StandardRicochetService) Outbox() *Outbox {
+	return srs.outbox
 }
 
-// Listen starts the ricochet service. Listen must be called before any other method (apart from Init)
-func (srs *StandardRicochetService) Listen(service RicochetService, port int) {
-	srs.ricochet.Server(service, port)
+// connectionAdded is called whenever a connection is authenticated.
+func (srs *StandardRicochetService) connectionAdded(oc *OpenConnection) {
+	srs.connectionManager.connectionAdded(oc)
+	srs.outbox.connectionAdded(oc)
 }
 
-// Connect can be called to initiate a new client connection to a server
-func (srs *StandardRicochetService) Connect(hostname string) error {
+// Connection returns the live, authenticated connection to the peer with the
+// given hostname, or nil if there is none.
+func (srs *StandardRicochetService) Connection(hostname string) *OpenConnection {
+	return srs.ricochet.Connection(hostname)
+}
+
+// Connections returns all live, authenticated connections.
+func (srs *StandardRicochetService) Connections() []*OpenConnection {
+	return srs.ricochet.Connections()
+}
+
+// CloseAll closes all live, authenticated connections.
+func (srs *StandardRicochetService) CloseAll() {
+	srs.ricochet.CloseAll()
+}
+
+// Shutdown stops maintaining connections to managed peers and gracefully shuts
+// down the service, see Ricochet.Shutdown. Listen returns once Shutdown has
+// been called.
+func (srs *StandardRicochetService) Shutdown(ctx context.Context) error {
+	srs.connectionManager.abandon()
+	return srs.ricochet.Shutdown(ctx)
+}
+
+// SetTorControl configures the service to publish itself as an onion service
+// through the given (already authenticated) Tor control connection when Listen
+// is called. Must be called after Init.
+func (srs *StandardRicochetService) SetTorControl(torControl *torcontrol.Conn) {
+	srs.torControl = torControl
+}
+
+// Listen starts the ricochet service on 127.0.0.1:port. Listen must be called before any other method (apart from Init)
+// It blocks until the service is shut down, and returns an error if the
+// service could not be started.
+func (srs *StandardRicochetService) Listen(service RicochetService, port int) error {
+	return srs.ListenAddr(service, "tcp", "127.0.0.1:"+strconv.Itoa(port))
+}
+
+// ListenAddr is like Listen, but listens on any address accepted by
+// net.Listen, e.g. ("unix", "/var/lib/tor/ricochet.sock") to be used with
+// "HiddenServicePort 9878 unix:/var/lib/tor/ricochet.sock".
+func (srs *StandardRicochetService) ListenAddr(service RicochetService, network string, address string) error {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return srs.ServeListener(service, ln)
+}
+
+// ServeListener starts the ricochet service on an existing listener, which
+// is closed when the service is shut down. It blocks until then.
+// If a Tor control connection has been configured the onion service is
+// published, with ln as its target, for as long as the service is listening.
+func (srs *StandardRicochetService) ServeListener(service RicochetService, ln net.Listener) error {
+	if srs.torControl != nil {
+		target := ln.Addr().String()
+		if ln.Addr().Network() == "unix" {
+			target = "unix:" + target
+		}
+		serviceID, err := srs.torControl.AddOnion(srs.identity.PrivateKey(), utils.DefaultRemotePort, target)
+		if err != nil {
+			ln.Close()
+			return errors.New("Could not publish onion service: " + err.Error())
+		}
+		defer srs.torControl.DelOnion(serviceID)
+		log.Printf("Published onion service %s", serviceID)
+	}
+	srs.ricochet.ServeListener(service, ln)
+	return nil
+}
+
+// Connect can be called to initiate a new client connection to a server. The
+// connection is returned as soon as version negotiation completes, before
+// authentication. Returns utils.BlockedError if the peer is blocked.
+func (srs *StandardRicochetService) Connect(hostname string) (*OpenConnection, error) {
+	if srs.IsBlocked(hostname) {
+		return nil, utils.BlockedError
+	}
 	log.Printf("Connecting to...%s", hostname)
 	oc, err := srs.ricochet.Connect(hostname)
 	if err != nil {
-		return errors.New("Could not connect to: " + hostname + " " + err.Error())
+		return nil, errors.New("Could not connect to: " + hostname + " " + err.Error())
 	}
-	oc.MyHostname = srs.serverHostname
-	return nil
+	return oc, nil
+}
+
+// ConnectContext initiates a new client connection to a server and, unlike
+// Connect, waits for the server to accept our authentication. Dialing, version
+// negotiation and authentication are all abandoned if ctx is cancelled or
+// expires first, in which case the connection is closed and ctx.Err() returned.
+//
+// If the peer connected to us at the same time and its connection was kept
+// instead, that connection is returned. Returns utils.BlockedError if the
+// peer is blocked.
+func (srs *StandardRicochetService) ConnectContext(ctx context.Context, hostname string) (*OpenConnection, error) {
+	if srs.IsBlocked(hostname) {
+		return nil, utils.BlockedError
+	}
+	log.Printf("Connecting to...%s", hostname)
+	oc, err := srs.ricochet.ConnectContext(ctx, hostname)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("Could not connect to: " + hostname + " " + err.Error())
+	}
+
+	accepted, err := oc.WaitForAuthentication(ctx)
+	if err != nil {
+		oc.Close()
+		return nil, err
+	}
+	if !accepted {
+		oc.Close()
+		return nil, utils.AuthenticationRejectedError
+	}
+	if oc.IsClosed() {
+		if kept := srs.Connection(oc.OtherHostname()); kept != nil {
+			return kept, nil
+		}
+		return nil, utils.ConnectionClosedError
+	}
+	return oc, nil
 }
 
 // OnConnect is called when a client or server successfully passes Version Negotiation.
 func (srs *StandardRicochetService) OnConnect(oc *OpenConnection) {
+	oc.SetMyHostname(srs.serverHostname)
 	if oc.Client {
-		log.Printf("Sucessefully Connected to %s", oc.OtherHostname)
-		oc.IsAuthed = true // Connections to Servers are Considered Authenticated by Default
+		log.Printf("Sucessefully Connected to %s", oc.OtherHostname())
 		oc.Authenticate(1)
-	} else {
-		oc.MyHostname = srs.serverHostname
 	}
 }
 
 // OnDisconnect is called when a connection is closed
 func (srs *StandardRicochetService) OnDisconnect(oc *OpenConnection) {
+	srs.outbox.connectionClosed(oc)
+
+	// A pending request can no longer be answered on this connection
+	srs.lock.Lock()
+	if pending, exists := srs.pendingRequests[oc.OtherHostname()]; exists && pending.oc == oc {
+		delete(srs.pendingRequests, oc.OtherHostname())
+	}
+	srs.lock.Unlock()
+}
+
+// AdvertiseFeatures sets the features this service is willing to enable when a
+// peer requests them.
+func (srs *StandardRicochetService) AdvertiseFeatures(features ...string) {
+	srs.features = features
+}
+
+// OnEnableFeatures is called when the peer requests features, the features
+// which the service has advertised are enabled.
+func (srs *StandardRicochetService) OnEnableFeatures(oc *OpenConnection, features []string) {
+	enabled := []string{}
+	for _, feature := range features {
+		for _, supported := range srs.features {
+			if feature == supported {
+				enabled = append(enabled, feature)
+				break
+			}
+		}
+	}
+	oc.SendFeaturesEnabled(enabled)
+}
+
+// OnFeaturesEnabled is called when the peer responds to a feature request with
+// the set of features now enabled on the connection.
+func (srs *StandardRicochetService) OnFeaturesEnabled(oc *OpenConnection, features []string) {
 }
 
 // OnAuthenticationRequest is called when a client requests Authentication
@@ -95,38 +437,99 @@ func (srs *StandardRicochetService) OnAuthenticationRequest(oc *OpenConnection,
 
 // OnAuthenticationChallenge constructs a valid authentication challenge to the serverCookie
 func (srs *StandardRicochetService) OnAuthenticationChallenge(oc *OpenConnection, channelID int32, serverCookie [16]byte) {
-	// DER Encode the Public Key
-	publickeyBytes, _ := asn1.Marshal(rsa.PublicKey{
-		N: srs.privateKey.PublicKey.N,
-		E: srs.privateKey.PublicKey.E,
-	})
-	oc.SendProof(1, serverCookie, publickeyBytes, srs.privateKey)
+	oc.SendProof(channelID, serverCookie, srs.identity.PublicKey, srs.identity.Signer())
 }
 
 // OnAuthenticationProof is called when a client sends Proof for an existing authentication challenge
-func (srs *StandardRicochetService) OnAuthenticationProof(oc *OpenConnection, channelID int32, publicKey []byte, signature []byte, isKnownContact bool) {
+// Blocked peers are refused even if their proof is valid, and disconnected.
+func (srs *StandardRicochetService) OnAuthenticationProof(oc *OpenConnection, channelID int32, publicKey []byte, signature []byte) {
 	result := oc.ValidateProof(channelID, publicKey, signature)
+	blocked := result && srs.IsBlocked(oc.OtherHostname())
+	if blocked {
+		log.Printf("Refusing authentication from blocked peer %s", oc.OtherHostname())
+		result = false
+	}
+	// Only reveal whether the peer is a known contact once it has proved
+	// which hostname it is.
+	isKnownContact := result && srs.IsKnownContact(oc.OtherHostname())
 	oc.SendAuthenticationResult(channelID, result, isKnownContact)
-	oc.IsAuthed = result
+	oc.SetAuthed(result)
 	oc.CloseChannel(channelID)
+	if blocked {
+		oc.Close()
+	}
 }
 
 // OnAuthenticationResult is called once a server has returned the result of the Proof Verification
 func (srs *StandardRicochetService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
-	oc.IsAuthed = result
+	oc.SetAuthed(result)
+}
+
+// OnAuthenticationFailed is called when the authentication handshake fails,
+// just before the connection is closed.
+func (srs *StandardRicochetService) OnAuthenticationFailed(oc *OpenConnection, reason error) {
+	log.Printf("Authentication with %s failed: %v", oc.OtherHostname(), reason)
 }
 
 // IsKnownContact allows a caller to determine if a hostname an authorized contact.
+// By default a hostname is a known contact if it is an accepted, unblocked
+// contact in the service's ContactStore.
 func (srs *StandardRicochetService) IsKnownContact(hostname string) bool {
-	return false
+	contact, exists := srs.contacts.GetContact(hostname)
+	return exists && contact.Status == ContactAccepted && !contact.Blocked
 }
 
 // OnContactRequest is called when a client sends a new contact request
+// The request is recorded in the ContactStore and answered according to the
+// service's ContactRequestPolicy. Requests from existing contacts are accepted.
 func (srs *StandardRicochetService) OnContactRequest(oc *OpenConnection, channelID int32, nick string, message string) {
+	contact, exists := srs.contacts.GetContact(oc.OtherHostname())
+	if exists && contact.Blocked {
+		oc.AckContactRequestOnResponse(channelID, ContactRejected.String())
+		oc.CloseChannel(channelID)
+		return
+	}
+	if exists && contact.Status == ContactAccepted {
+		oc.AckContactRequestOnResponse(channelID, ContactAccepted.String())
+		oc.CloseChannel(channelID)
+		return
+	}
+	if !exists {
+		contact = Contact{Hostname: oc.OtherHostname()}
+	}
+	contact.Nickname = nick
+	contact.Message = message
+	contact.Status = srs.contactPolicy.Decide(oc.OtherHostname(), nick, message)
+	if err := srs.contacts.SaveContact(contact); err != nil {
+		log.Printf("Could not save contact request from %s: %v", oc.OtherHostname(), err)
+	}
+
+	oc.AckContactRequestOnResponse(channelID, contact.Status.String())
+	if contact.Status == ContactPending {
+		srs.lock.Lock()
+		srs.pendingRequests[oc.OtherHostname()] = pendingContactRequest{oc, channelID}
+		srs.lock.Unlock()
+	} else {
+		oc.CloseChannel(channelID)
+	}
 }
 
 // OnContactRequestAck is called when a server sends a reply to an existing contact request
+// The reply is recorded in the ContactStore.
 func (srs *StandardRicochetService) OnContactRequestAck(oc *OpenConnection, channelID int32, status string) {
+	var contactStatus ContactStatus
+	if err := contactStatus.UnmarshalText([]byte(status)); err != nil {
+		return
+	}
+
+	contact, exists := srs.contacts.GetContact(oc.OtherHostname())
+	if !exists {
+		contact = Contact{Hostname: oc.OtherHostname()}
+	}
+	contact.Status = contactStatus
+	if err := srs.contacts.SaveContact(contact); err != nil {
+		log.Printf("Could not save contact request reply from %s: %v", oc.OtherHostname(), err)
+	}
 }
 
 // OnOpenChannelRequest is called when a client or server requests to open a new channel
@@ -136,24 +539,30 @@ func (srs *StandardRicochetService) OnOpenChannelRequest(oc *OpenConnection, cha
 
 // OnOpenChannelRequestSuccess is called when a client or server responds to an open channel request
 func (srs *StandardRicochetService) OnOpenChannelRequestSuccess(oc *OpenConnection, channelID int32) {
+	srs.outbox.channelOpened(oc, channelID)
 }
 
 // OnChannelClosed is called when a client or server closes an existing channel
 func (srs *StandardRicochetService) OnChannelClosed(oc *OpenConnection, channelID int32) {
+	srs.outbox.channelClosed(oc, channelID)
 }
 
-// OnChatMessage is called when a new chat message is received.
-func (srs *StandardRicochetService) OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string) {
+// OnChatMessage is called when a new chat message is received, with the time
+// the message was written.
+func (srs *StandardRicochetService) OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string, written time.Time) {
 	oc.AckChatMessage(channelID, messageID)
 }
 
-// OnChatMessageAck is called when a new chat message is ascknowledged.
-func (srs *StandardRicochetService) OnChatMessageAck(oc *OpenConnection, channelID int32, messageID int32) {
+// OnChatMessageAck is called when a chat message we sent is acknowledged,
+// with accepted false if the peer refused it.
+func (srs *StandardRicochetService) OnChatMessageAck(oc *OpenConnection, channelID int32, messageID int32, accepted bool) {
+	srs.outbox.acknowledged(oc, channelID, messageID, accepted)
 }
 
 // OnFailedChannelOpen is called when a server fails to open a channel
 func (srs *StandardRicochetService) OnFailedChannelOpen(oc *OpenConnection, channelID int32, errorType string) {
 	oc.UnsetChannel(channelID)
+	srs.outbox.channelFailed(oc, channelID)
 }
 
 // OnGenericError is called when a generalized error is returned from the peer
@@ -180,3 +589,9 @@ func (srs *StandardRicochetService) OnBadUsageError(oc *OpenConnection, channelI
 func (srs *StandardRicochetService) OnFailedError(oc *OpenConnection, channelID int32) {
 	oc.RejectOpenChannel(channelID, "FailedError")
 }
+
+// OnLimitExceeded is called when the peer sends a nickname or message which
+// exceeds the protocol's limits.
+func (srs *StandardRicochetService) OnLimitExceeded(oc *OpenConnection, channelID int32, err error) {
+	log.Printf("Rejected message from %s on channel %d: %v", oc.OtherHostname(), channelID, err)
+}
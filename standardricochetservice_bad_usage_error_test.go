@@ -3,28 +3,44 @@ package goricochet
 import "testing"
 import "time"
 import "log"
+import "sync"
+import "github.com/s-rah/go-ricochet/utils"
 
 type TestBadUsageService struct {
 	StandardRicochetService
+	lock                  sync.Mutex
 	BadUsageErrorCount    int
 	UnknownTypeErrorCount int
 	ChannelClosed         int
 }
 
+// requestAuthentication sends a request to open an authentication channel,
+// bypassing our own authentication state so that the peer's checks are tested.
+func requestAuthentication(oc *OpenConnection, channel int32) {
+	if oc.Authenticate(channel) != utils.AuthenticationProtocolError {
+		log.Printf("Expected Authenticate on channel %v to be refused locally", channel)
+		return
+	}
+	messageBuilder := new(MessageBuilder)
+	data, _ := messageBuilder.OpenAuthenticationChannel(channel, [16]byte{})
+	oc.setChannel(channel, "im.ricochet.auth.hidden-service")
+	oc.send(0, data)
+}
+
 func (ts *TestBadUsageService) OnConnect(oc *OpenConnection) {
 	if oc.Client {
 		oc.OpenChannel(17, "im.ricochet.auth.hidden-service") // Fail because no Extension
 	}
 	ts.StandardRicochetService.OnConnect(oc)
 	if oc.Client {
-		oc.Authenticate(103) // Should Fail because cannot open more than one auth-hidden-service channel at once
+		requestAuthentication(oc, 103) // Should Fail because cannot open more than one auth-hidden-service channel at once
 	}
 }
 
-func (ts *TestBadUsageService) OnAuthenticationProof(oc *OpenConnection, channelID int32, publicKey []byte, signature []byte, isKnownContact bool) {
-	oc.Authenticate(2)                       // Try to authenticate again...will fail servers don't auth
+func (ts *TestBadUsageService) OnAuthenticationProof(oc *OpenConnection, channelID int32, publicKey []byte, signature []byte) {
+	requestAuthentication(oc, 2)             // Try to authenticate again...will fail servers don't auth
 	oc.SendContactRequest(4, "test", "test") // Only clients can send contact requests
-	ts.StandardRicochetService.OnAuthenticationProof(oc, channelID, publicKey, signature, isKnownContact)
+	ts.StandardRicochetService.OnAuthenticationProof(oc, channelID, publicKey, signature)
 	oc.OpenChatChannel(5) // Fail because server can only open even numbered channels
 	oc.OpenChatChannel(3) // Fail because already in use...
 }
@@ -44,7 +60,7 @@ func (ts *TestBadUsageService) OnAuthenticationResult(oc *OpenConnection, channe
 
 	oc.SendMessage(101, "test") // Should fail as 101 doesn't exist
 
-	oc.Authenticate(1) // Try to authenticate again...will fail because we have already authenticated
+	requestAuthentication(oc, 1) // Try to authenticate again...will fail because we have already authenticated
 
 	oc.OpenChannel(19, "im.ricochet.contact.request") // Will Fail
 	oc.SendContactRequest(11, "test", "test")         // Succeed
@@ -57,13 +73,17 @@ func (ts *TestBadUsageService) OnAuthenticationResult(oc *OpenConnection, channe
 func (ts *TestBadUsageService) OnChannelClosed(oc *OpenConnection, channelID int32) {
 	if channelID == 101 {
 		log.Printf("Received Channel Closed: %v", channelID)
+		ts.lock.Lock()
 		ts.ChannelClosed++
+		ts.lock.Unlock()
 	}
 }
 
 func (ts *TestBadUsageService) OnFailedChannelOpen(oc *OpenConnection, channelID int32, errorType string) {
 	log.Printf("Failed Channel Open %v %v", channelID, errorType)
 	ts.StandardRicochetService.OnFailedChannelOpen(oc, channelID, errorType)
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
 	if errorType == "BadUsageError" {
 		ts.BadUsageErrorCount++
 	} else if errorType == "UnknownTypeError" {
@@ -95,12 +115,16 @@ func TestBadUsageServer(t *testing.T) {
 	}
 
 	go ricochetService2.Listen(ricochetService2, 9885)
-	err = ricochetService2.Connect("127.0.0.1:9884|kwke2hntvyfqm7dr")
+	_, err = ricochetService2.Connect("127.0.0.1:9884|kwke2hntvyfqm7dr")
 	if err != nil {
 		t.Errorf("Could not connect to ricochet service:  %v", err)
 	}
 
 	time.Sleep(time.Second * 3)
+	ricochetService.lock.Lock()
+	defer ricochetService.lock.Unlock()
+	ricochetService2.lock.Lock()
+	defer ricochetService2.lock.Unlock()
 	if ricochetService2.ChannelClosed != 1 || ricochetService2.BadUsageErrorCount != 7 || ricochetService.BadUsageErrorCount != 4 || ricochetService2.UnknownTypeErrorCount != 1 {
 		t.Errorf("Invalid number of errors seen Closed:%v, Client Bad Usage:%v UnknownTypeErrorCount: %v, Server Bad Usage: %v ", ricochetService2.ChannelClosed, ricochetService2.BadUsageErrorCount, ricochetService2.UnknownTypeErrorCount, ricochetService.BadUsageErrorCount)
 	}
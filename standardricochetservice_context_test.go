@@ -0,0 +1,98 @@
+package goricochet
+
+import "testing"
+import "time"
+import "net"
+import "io"
+import "io/ioutil"
+import "context"
+
+// silentPeer accepts connections on address and then, after optionally
+// negotiating a version, never responds.
+func silentPeer(t *testing.T, address string, negotiate bool) net.Listener {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if negotiate {
+			header := make([]byte, 4)
+			io.ReadFull(conn, header)
+			conn.Write([]byte{0x01})
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+	return ln
+}
+
+func TestConnectContextVersionTimeout(t *testing.T) {
+	ln := silentPeer(t, "127.0.0.1:9893", false)
+	defer ln.Close()
+
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9894)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	start := time.Now()
+	_, err = ricochetService.ConnectContext(ctx, "127.0.0.1:9893|kwke2hntvyfqm7dr")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected version negotiation to time out, got %v", err)
+	}
+	if time.Since(start) > time.Second*2 {
+		t.Errorf("ConnectContext did not respect the deadline")
+	}
+}
+
+func TestConnectContextAuthTimeout(t *testing.T) {
+	ln := silentPeer(t, "127.0.0.1:9895", true)
+	defer ln.Close()
+
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9896)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	_, err = ricochetService.ConnectContext(ctx, "127.0.0.1:9895|kwke2hntvyfqm7dr")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected authentication to time out, got %v", err)
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.Listen(ricochetService, 9897)
+
+	time.Sleep(time.Second * 2)
+
+	ricochetService2 := new(StandardRicochetService)
+	err = ricochetService2.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService2.Listen(ricochetService2, 9898)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err = ricochetService2.ConnectContext(ctx, "127.0.0.1:9897|kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Errorf("Could not connect and authenticate to ricochet service: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package goricochet
+
+import "testing"
+import "time"
+import "context"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "github.com/s-rah/go-ricochet/identity"
+
+// writeTestV3Key writes a new Ed25519 key to dir and returns its filename.
+func writeTestV3Key(t *testing.T, dir string, name string) string {
+	id, err := identity.Generate(identity.V3)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	filename := filepath.Join(dir, name)
+	if err := id.Save(filename); err != nil {
+		t.Fatalf("Could not write key: %v", err)
+	}
+	return filename
+}
+
+func TestV3Identity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ricochet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v3Service := new(StandardRicochetService)
+	if err := v3Service.Init(writeTestV3Key(t, dir, "v3_key")); err != nil {
+		t.Fatalf("Could not initate ricochet service: %v", err)
+	}
+	v3Hostname := v3Service.Identity().Hostname()
+	if v3Service.Identity().Version() != identity.V3 || len(v3Hostname) != 56 {
+		t.Fatalf("Expected a v3 identity, got %v", v3Hostname)
+	}
+	v3Service.SetContactRequestPolicy(AcceptAllContactRequests)
+	go v3Service.Listen(v3Service, 9925)
+
+	v2Service := new(StandardRicochetService)
+	v2Service.Init("./private_key")
+	go v2Service.Listen(v2Service, 9926)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// A v2 peer authenticates to a v3 service
+	if _, err := v2Service.ConnectContext(ctx, "127.0.0.1:9925|"+v3Hostname); err != nil {
+		t.Fatalf("Could not connect to v3 service: %v", err)
+	}
+	// A v3 peer authenticates to a v2 service
+	v3Client := new(StandardRicochetService)
+	v3Client.Init(writeTestV3Key(t, dir, "v3_client_key"))
+	go v3Client.Listen(v3Client, 9927)
+	time.Sleep(time.Millisecond * 100)
+	if _, err := v3Client.ConnectContext(ctx, "127.0.0.1:9926|kwke2hntvyfqm7dr"); err != nil {
+		t.Fatalf("Could not connect to v2 service: %v", err)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if v3Service.Connection("kwke2hntvyfqm7dr") == nil {
+		t.Errorf("Expected the v3 service to have authenticated kwke2hntvyfqm7dr")
+	}
+	if v2Service.Connection(v3Client.Identity().Hostname()) == nil {
+		t.Errorf("Expected the v2 service to have authenticated %v", v3Client.Identity().Hostname())
+	}
+}
+
+func TestInitWithIdentity(t *testing.T) {
+	id, err := identity.Generate(identity.V3)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	ricochetService := new(StandardRicochetService)
+	if err := ricochetService.InitWithIdentity(id); err != nil {
+		t.Fatalf("Could not initate ricochet service: %v", err)
+	}
+	if ricochetService.Identity().Hostname() != id.Hostname() {
+		t.Errorf("Expected the service to use the given identity")
+	}
+	if err := new(StandardRicochetService).InitWithIdentity(nil); err == nil {
+		t.Errorf("Expected initialising without an identity to fail")
+	}
+}
@@ -0,0 +1,90 @@
+package goricochet
+
+import "testing"
+import "time"
+import "net"
+import "context"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+
+func TestListenAddrUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ricochet")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "ricochet.sock")
+
+	ricochetService := new(StandardRicochetService)
+	err = ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	go ricochetService.ListenAddr(ricochetService, "unix", socket)
+
+	time.Sleep(time.Millisecond * 100)
+
+	ricochetService2 := new(StandardRicochetService)
+	ricochetService2.Init("./private_key")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go ricochetService2.ServeListener(ricochetService2, ln)
+	defer ricochetService2.Shutdown(context.Background())
+
+	time.Sleep(time.Millisecond * 100)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Could not dial unix socket: %v", err)
+	}
+	oc, err := ricochetService2.ricochet.ConnectOpen(conn, "kwke2hntvyfqm7dr")
+	if err != nil {
+		t.Fatalf("Could not connect over unix socket: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	accepted, err := oc.WaitForAuthentication(ctx)
+	if err != nil || !accepted {
+		t.Errorf("Expected to authenticate over unix socket: %v %v", accepted, err)
+	}
+
+	err = ricochetService.Shutdown(ctx)
+	if err != nil {
+		t.Errorf("Could not shut down: %v", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the unix socket to be removed on shutdown")
+	}
+}
+
+func TestListenReturnsError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9909")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer ln.Close()
+
+	ricochetService := new(StandardRicochetService)
+	err = ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- ricochetService.Listen(ricochetService, 9909)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Expected Listen to fail on a port in use")
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("Listen did not return on a port in use")
+	}
+}
@@ -3,11 +3,12 @@ package goricochet
 import "testing"
 import "time"
 import "log"
+import "sync"
 
 type TestService struct {
 	StandardRicochetService
+	lock            sync.Mutex
 	ReceivedMessage bool
-	KnownContact    bool // Mocking contact request
 }
 
 func (ts *TestService) OnAuthenticationResult(oc *OpenConnection, channelID int32, result bool, isKnownContact bool) {
@@ -18,14 +19,6 @@ func (ts *TestService) OnAuthenticationResult(oc *OpenConnection, channelID int3
 	}
 }
 
-func (ts *TestService) OnContactRequest(oc *OpenConnection, channelID int32, nick string, message string) {
-	ts.StandardRicochetService.OnContactRequest(oc, channelID, nick, message)
-	oc.AckContactRequestOnResponse(channelID, "Pending")
-	oc.AckContactRequest(channelID, "Accepted")
-	ts.KnownContact = true
-	oc.CloseChannel(channelID)
-}
-
 func (ts *TestService) OnOpenChannelRequestSuccess(oc *OpenConnection, channelID int32) {
 	ts.StandardRicochetService.OnOpenChannelRequestSuccess(oc, channelID)
 	oc.SendMessage(channelID, "TEST MESSAGE")
@@ -35,24 +28,21 @@ func (ts *TestService) OnContactRequestAck(oc *OpenConnection, channelID int32,
 	ts.StandardRicochetService.OnContactRequestAck(oc, channelID, status)
 	if status == "Accepted" {
 		log.Printf("Got accepted contact request")
-		ts.KnownContact = true
 		oc.OpenChatChannel(5)
 	} else if status == "Pending" {
 		log.Printf("Got pending contact request")
 	}
 }
 
-func (ts *TestService) OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string) {
-	ts.StandardRicochetService.OnChatMessage(oc, channelID, messageID, message)
+func (ts *TestService) OnChatMessage(oc *OpenConnection, channelID int32, messageID int32, message string, written time.Time) {
+	ts.StandardRicochetService.OnChatMessage(oc, channelID, messageID, message, written)
 	if message == "TEST MESSAGE" {
+		ts.lock.Lock()
 		ts.ReceivedMessage = true
+		ts.lock.Unlock()
 	}
 }
 
-func (ts *TestService) IsKnownContact(hostname string) bool {
-	return ts.KnownContact
-}
-
 func TestServer(t *testing.T) {
 	ricochetService := new(TestService)
 	err := ricochetService.Init("./private_key")
@@ -60,6 +50,7 @@ func TestServer(t *testing.T) {
 	if err != nil {
 		t.Errorf("Could not initate ricochet service: %v", err)
 	}
+	ricochetService.SetContactRequestPolicy(AcceptAllContactRequests)
 
 	go ricochetService.Listen(ricochetService, 9878)
 
@@ -73,12 +64,14 @@ func TestServer(t *testing.T) {
 	}
 
 	go ricochetService2.Listen(ricochetService2, 9879)
-	err = ricochetService2.Connect("127.0.0.1:9878|kwke2hntvyfqm7dr")
+	_, err = ricochetService2.Connect("127.0.0.1:9878|kwke2hntvyfqm7dr")
 	if err != nil {
 		t.Errorf("Could not connect to ricochet service:  %v", err)
 	}
 
 	time.Sleep(time.Second * 5) // Wait a bit longer
+	ricochetService.lock.Lock()
+	defer ricochetService.lock.Unlock()
 	if !ricochetService.ReceivedMessage {
 		t.Errorf("Test server did not receive message")
 	}
@@ -100,7 +93,7 @@ func TestServerCouldNotConnect(t *testing.T) {
 	if err != nil {
 		t.Errorf("Could not initate ricochet service: %v", err)
 	}
-	err = ricochetService.Connect("127.0.0.1:65535|kwke2hntvyfqm7dr")
+	_, err = ricochetService.Connect("127.0.0.1:65535|kwke2hntvyfqm7dr")
 	if err == nil {
 		t.Errorf("Should not have been been able to connect to 127.0.0.1:65535|kwke2hntvyfqm7dr")
 	}
@@ -0,0 +1,114 @@
+package goricochet
+
+import "testing"
+import "time"
+import "net"
+import "net/textproto"
+import "strings"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "github.com/s-rah/go-ricochet/utils/torcontrol"
+
+// fakeTorControl returns a control connection to a fake tor which accepts
+// every command, reporting each one on commands.
+func fakeTorControl() (*torcontrol.Conn, chan string) {
+	client, server := net.Pipe()
+	commands := make(chan string, 10)
+	go func() {
+		tp := textproto.NewConn(server)
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			commands <- line
+			if strings.HasPrefix(line, "ADD_ONION") {
+				tp.PrintfLine("250-ServiceID=kwke2hntvyfqm7dr")
+			}
+			tp.PrintfLine("250 OK")
+		}
+	}()
+	return torcontrol.NewConn(client), commands
+}
+
+func TestListenPublishesOnion(t *testing.T) {
+	torControl, commands := fakeTorControl()
+
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.SetTorControl(torControl)
+
+	go ricochetService.Listen(ricochetService, 9899)
+
+	select {
+	case command := <-commands:
+		if !strings.HasPrefix(command, "ADD_ONION RSA1024:") || !strings.HasSuffix(command, "Port=9878,127.0.0.1:9899") {
+			t.Errorf("Unexpected command sent to tor: %v", command)
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("Listen did not publish an onion service")
+	}
+}
+
+func TestListenAddrPublishesUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ricochet")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "ricochet.sock")
+
+	torControl, commands := fakeTorControl()
+
+	ricochetService := new(StandardRicochetService)
+	err = ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.SetTorControl(torControl)
+
+	go ricochetService.ListenAddr(ricochetService, "unix", socket)
+
+	select {
+	case command := <-commands:
+		if !strings.HasSuffix(command, "Port=9878,unix:"+socket) {
+			t.Errorf("Unexpected command sent to tor: %v", command)
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("ListenAddr did not publish an onion service")
+	}
+}
+
+func TestListenReportsPublishError(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		tp := textproto.NewConn(server)
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "ADD_ONION") {
+				tp.PrintfLine("512 Invalid key")
+			} else {
+				tp.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	ricochetService := new(StandardRicochetService)
+	err := ricochetService.Init("./private_key")
+	if err != nil {
+		t.Errorf("Could not initate ricochet service: %v", err)
+	}
+	ricochetService.SetTorControl(torcontrol.NewConn(client))
+
+	err = ricochetService.Listen(ricochetService, 9936)
+	if err == nil {
+		t.Errorf("Listen should have failed to publish the onion service")
+	}
+}
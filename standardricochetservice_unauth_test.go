@@ -3,6 +3,7 @@ package goricochet
 import "testing"
 import "time"
 import "log"
+import "sync"
 
 // The purpose of this test is to exercise the Unauthorized Error flows that occur
 // when a client attempts to open a Chat Channel or Send a Contact Reuqest before Authentication
@@ -10,13 +11,14 @@ import "log"
 
 type TestUnauthorizedService struct {
 	StandardRicochetService
+	lock         sync.Mutex
 	FailedToOpen int
 }
 
 func (ts *TestUnauthorizedService) OnConnect(oc *OpenConnection) {
 	if oc.Client {
 		log.Printf("Attempting Authentication Not Authorized")
-		oc.IsAuthed = true // Connections to Servers are Considered Authenticated by Default
+		oc.SetAuthed(true) // Not enough to authenticate, the server has not accepted a proof from us
 		// REMOVED Authenticate
 		oc.OpenChatChannel(5)
 		oc.SendContactRequest(3, "test", "test")
@@ -26,7 +28,9 @@ func (ts *TestUnauthorizedService) OnConnect(oc *OpenConnection) {
 func (ts *TestUnauthorizedService) OnFailedChannelOpen(oc *OpenConnection, channelID int32, errorType string) {
 	oc.UnsetChannel(channelID)
 	if errorType == "UnauthorizedError" {
+		ts.lock.Lock()
 		ts.FailedToOpen++
+		ts.lock.Unlock()
 	}
 }
 
@@ -50,12 +54,14 @@ func TestUnauthorizedClientReject(t *testing.T) {
 	}
 
 	go ricochetService2.Listen(ricochetService2, 9881)
-	err = ricochetService2.Connect("127.0.0.1:9880|kwke2hntvyfqm7dr")
+	_, err = ricochetService2.Connect("127.0.0.1:9880|kwke2hntvyfqm7dr")
 	if err != nil {
 		t.Errorf("Could not connect to ricochet service:  %v", err)
 	}
 
 	time.Sleep(time.Second * 2)
+	ricochetService2.lock.Lock()
+	defer ricochetService2.lock.Unlock()
 	if ricochetService2.FailedToOpen != 2 {
 		t.Errorf("Test server did not reject open channels with unauthorized error")
 	}
@@ -3,9 +3,11 @@ package goricochet
 import "testing"
 import "time"
 import "log"
+import "sync"
 
 type TestUnknownContactService struct {
 	StandardRicochetService
+	lock         sync.Mutex
 	FailedToOpen bool
 }
 
@@ -19,7 +21,9 @@ func (ts *TestUnknownContactService) OnFailedChannelOpen(oc *OpenConnection, cha
 	log.Printf("Failed Channel Open %v", errorType)
 	oc.UnsetChannel(channelID)
 	if errorType == "UnauthorizedError" {
+		ts.lock.Lock()
 		ts.FailedToOpen = true
+		ts.lock.Unlock()
 	}
 }
 
@@ -47,12 +51,14 @@ func TestUnknownContactServer(t *testing.T) {
 	}
 
 	go ricochetService2.Listen(ricochetService2, 9883)
-	err = ricochetService2.Connect("127.0.0.1:9882|kwke2hntvyfqm7dr")
+	_, err = ricochetService2.Connect("127.0.0.1:9882|kwke2hntvyfqm7dr")
 	if err != nil {
 		t.Errorf("Could not connect to ricochet service:  %v", err)
 	}
 
 	time.Sleep(time.Second * 2)
+	ricochetService2.lock.Lock()
+	defer ricochetService2.lock.Unlock()
 	if !ricochetService2.FailedToOpen {
 		t.Errorf("Test server did receive message should have failed")
 	}
@@ -3,7 +3,98 @@ package utils
 import "fmt"
 import "log"
 
+// Error captures various common ricochet errors
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+const (
+	// ConnectionClosedError is returned when attempting to send on a
+	// connection which has already been closed.
+	ConnectionClosedError = Error("ConnectionClosedError")
+
+	// AuthenticationRejectedError is returned when the peer did not accept
+	// our proof of identity.
+	AuthenticationRejectedError = Error("AuthenticationRejectedError")
+
+	// AuthenticationProtocolError is returned when an authentication message
+	// is sent or received out of turn in the authentication handshake.
+	AuthenticationProtocolError = Error("AuthenticationProtocolError")
+
+	// AuthenticationTimeoutError is returned when a step of the
+	// authentication handshake takes too long.
+	AuthenticationTimeoutError = Error("AuthenticationTimeoutError")
+
+	// AuthenticationGracePeriodError is returned when a connection does not
+	// authenticate within the grace period.
+	AuthenticationGracePeriodError = Error("AuthenticationGracePeriodError")
+
+	// PacketTooLargeError is returned when data does not fit in a single
+	// ricochet packet.
+	PacketTooLargeError = Error("PacketTooLargeError")
+
+	// InvalidChannelIDError is returned when a channel identifier is outside
+	// the range that can be encoded in a packet.
+	InvalidChannelIDError = Error("InvalidChannelIDError")
+
+	// InvalidPacketLengthError is returned when a received packet header
+	// declares an impossible length.
+	InvalidPacketLengthError = Error("InvalidPacketLengthError")
+
+	// MessageTooLongError is returned when a chat or contact request message
+	// exceeds the protocol's length limit.
+	MessageTooLongError = Error("MessageTooLongError")
+
+	// NicknameTooLongError is returned when a contact request nickname
+	// exceeds the protocol's length limit.
+	NicknameTooLongError = Error("NicknameTooLongError")
+
+	// UnknownContactStatusError is returned when decoding a contact status
+	// which does not exist.
+	UnknownContactStatusError = Error("UnknownContactStatusError")
+
+	// UnsupportedKeyError is returned when a private key is not of a type
+	// which can be used as a ricochet identity.
+	UnsupportedKeyError = Error("UnsupportedKeyError")
+
+	// InvalidPrivateKeyError is returned when a private key cannot be
+	// decoded or parsed.
+	InvalidPrivateKeyError = Error("InvalidPrivateKeyError")
+
+	// PassphraseRequiredError is returned when loading an encrypted private
+	// key without a passphrase.
+	PassphraseRequiredError = Error("PassphraseRequiredError")
+
+	// IncorrectPassphraseError is returned when an encrypted private key
+	// cannot be decrypted with the given passphrase.
+	IncorrectPassphraseError = Error("IncorrectPassphraseError")
+
+	// KeyNotFoundError is returned when there is no private key at the
+	// given location.
+	KeyNotFoundError = Error("KeyNotFoundError")
+
+	// InvalidPublicKeyError is returned when an authentication proof contains
+	// a public key which cannot be parsed.
+	InvalidPublicKeyError = Error("InvalidPublicKeyError")
+
+	// KeyMismatchError is returned when signing for an identity with a
+	// signer which holds a different key.
+	KeyMismatchError = Error("KeyMismatchError")
+
+	// BlockedError is returned when attempting to connect to a blocked peer.
+	BlockedError = Error("BlockedError")
+
+	// ShutdownError is returned when attempting to connect through a
+	// service which has been shut down.
+	ShutdownError = Error("ShutdownError")
+)
+
 // RecoverFromError doesn't really recover from anything....see comment below
+//
+// Deprecated: OpenConnection methods now return errors rather than panicking,
+// so there is nothing left to recover from.
 func RecoverFromError() {
 	if r := recover(); r != nil {
 		// This should only really happen if there is a failure de/serializing. If
@@ -16,6 +107,8 @@ func RecoverFromError() {
 // CheckError is a helper function for panicing on errors which we need to handle
 // but should be very rare e.g. failures deserializing a protobuf object that
 // should only happen if there was a bug in the underlying library.
+//
+// Deprecated: return the error to the caller instead.
 func CheckError(err error) {
 	if err != nil {
 		panic(fmt.Sprintf("%v", err))
@@ -1,52 +1,162 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"golang.org/x/net/proxy"
 	"net"
+	"strconv"
 	"strings"
 )
 
+const (
+	// DefaultProxyAddress is the address of the Tor SOCKS proxy used when none is configured.
+	DefaultProxyAddress = "127.0.0.1:9050"
+
+	// DefaultRemotePort is the port ricochet services are published on.
+	DefaultRemotePort = 9878
+)
+
 // NetworkResolver allows a client to resolve various hostnames to connections
 // The supported types are onions address are:
 //  * ricochet:jlq67qzo6s4yp3sp
 //  * jlq67qzo6s4yp3sp
+//  * jlq67qzo6s4yp3sp.onion, optionally with a port e.g. jlq67qzo6s4yp3sp.onion:9878
 //  * 127.0.0.1:55555|jlq67qzo6s4yp3sp - Localhost Connection
+//
+// Hostnames are case insensitive and are returned in the form given by
+// ParseOnionHostname.
+//
+// Onion addresses are dialed through Tor's SOCKS proxy. The zero value uses
+// the proxy at DefaultProxyAddress and connects to DefaultRemotePort.
 type NetworkResolver struct {
+	// ProxyNetwork is the network of the SOCKS proxy, "tcp" (the default)
+	// or "unix".
+	ProxyNetwork string
+
+	// ProxyAddress is the address of the SOCKS proxy e.g. 127.0.0.1:9150,
+	// or the path of its socket when ProxyNetwork is "unix".
+	ProxyAddress string
+
+	// ProxyAuth are optional credentials sent to the SOCKS proxy. Tor
+	// isolates streams which use different credentials.
+	ProxyAuth *proxy.Auth
+
+	// Dialer is used to connect to the SOCKS proxy, defaults to proxy.Direct.
+	Dialer proxy.Dialer
+
+	// RemotePort is the port of the remote ricochet service.
+	RemotePort int
+}
+
+// ParseOnionHostname returns the onion hostname (e.g. jlq67qzo6s4yp3sp) from
+// any of the hostname forms accepted by Resolve, or from an onion address such
+// as "jlq67qzo6s4yp3sp.onion:9878".
+func ParseOnionHostname(hostname string) string {
+	if i := strings.Index(hostname, "|"); i != -1 {
+		return strings.ToLower(hostname[i+1:])
+	}
+	hostname = strings.TrimPrefix(hostname, "ricochet:")
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+	return strings.ToLower(strings.TrimSuffix(hostname, ".onion"))
+}
+
+// proxyDialer returns a dialer which connects through the configured SOCKS proxy.
+func (nr *NetworkResolver) proxyDialer() (proxy.Dialer, error) {
+	network := nr.ProxyNetwork
+	if network == "" {
+		network = "tcp"
+	}
+	address := nr.ProxyAddress
+	if address == "" {
+		address = DefaultProxyAddress
+	}
+	forward := nr.Dialer
+	if forward == nil {
+		forward = proxy.Direct
+	}
+	return proxy.SOCKS5(network, address, nr.ProxyAuth, forward)
+}
+
+// remotePort returns the port to connect to on the remote service.
+func (nr *NetworkResolver) remotePort() int {
+	if nr.RemotePort == 0 {
+		return DefaultRemotePort
+	}
+	return nr.RemotePort
 }
 
 // Resolve takes a hostname and returns a net.Conn to the derived endpoint
 func (nr *NetworkResolver) Resolve(hostname string) (net.Conn, string, error) {
+	return nr.ResolveContext(context.Background(), hostname)
+}
+
+// ResolveContext takes a hostname and returns a net.Conn to the derived endpoint.
+// Dialing is abandoned if ctx is cancelled or expires before a connection is made.
+func (nr *NetworkResolver) ResolveContext(ctx context.Context, hostname string) (net.Conn, string, error) {
 	if strings.HasPrefix(hostname, "127.0.0.1") {
 		addrParts := strings.Split(hostname, "|")
 		tcpAddr, err := net.ResolveTCPAddr("tcp", addrParts[0])
 		if err != nil {
 			return nil, "", errors.New("Cannot Resolve Local TCP Address")
 		}
-		conn, err := net.DialTCP("tcp", nil, tcpAddr)
+		dialer := new(net.Dialer)
+		conn, err := dialer.DialContext(ctx, "tcp", tcpAddr.String())
 		if err != nil {
 			return nil, "", errors.New("Cannot Dial Local TCP Address")
 		}
 
 		// return just the onion address, not the local override for the hostname
-		return conn, addrParts[1], nil
+		return conn, ParseOnionHostname(hostname), nil
 	}
 
-	resolvedHostname := hostname
-	if strings.HasPrefix(hostname, "ricochet:") {
-		addrParts := strings.Split(hostname, ":")
-		resolvedHostname = addrParts[1]
+	resolvedHostname := ParseOnionHostname(hostname)
+	port := strconv.Itoa(nr.remotePort())
+	if _, p, err := net.SplitHostPort(strings.TrimPrefix(hostname, "ricochet:")); err == nil {
+		port = p
 	}
 
-	torDialer, err := proxy.SOCKS5("tcp", "127.0.0.1:9050", nil, proxy.Direct)
+	torDialer, err := nr.proxyDialer()
 	if err != nil {
 		return nil, "", err
 	}
 
-	conn, err := torDialer.Dial("tcp", resolvedHostname+".onion:9878")
+	conn, err := dialContext(ctx, torDialer, "tcp", net.JoinHostPort(resolvedHostname+".onion", port))
 	if err != nil {
 		return nil, "", errors.New("Cannot Dial Remote Ricochet Address")
 	}
-	//conn.SetDeadline(time.Now().Add(5 * time.Second))
 	return conn, resolvedHostname, nil
 }
+
+// dialContext dials address with dialer, giving up when ctx is done. Dialers
+// which do not support contexts are dialed in the background and the resulting
+// connection discarded if ctx finishes first.
+func dialContext(ctx context.Context, dialer proxy.Dialer, network string, address string) (net.Conn, error) {
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, network, address)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		conn, err := dialer.Dial(network, address)
+		result <- dialResult{conn, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-result; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"golang.org/x/net/proxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// socksRequest records what a client asked of fakeSOCKS5Proxy
+type socksRequest struct {
+	user string
+	pass string
+	host string
+	port int
+}
+
+// fakeSOCKS5Proxy accepts a single connection on ln, performs a username/password
+// authenticated SOCKS5 CONNECT handshake and reports the request.
+func fakeSOCKS5Proxy(ln net.Listener, requests chan socksRequest) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var request socksRequest
+	greeting := make([]byte, 2)
+	io.ReadFull(conn, greeting)
+	io.ReadFull(conn, make([]byte, greeting[1]))
+	conn.Write([]byte{0x05, 0x02})
+
+	header := make([]byte, 2)
+	io.ReadFull(conn, header)
+	user := make([]byte, header[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, header[:1])
+	pass := make([]byte, header[0])
+	io.ReadFull(conn, pass)
+	request.user, request.pass = string(user), string(pass)
+	conn.Write([]byte{0x01, 0x00})
+
+	connect := make([]byte, 5)
+	io.ReadFull(conn, connect)
+	host := make([]byte, connect[4])
+	io.ReadFull(conn, host)
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	request.host, request.port = string(host), int(port[0])<<8|int(port[1])
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	requests <- request
+	io.Copy(ioutil.Discard, conn)
+}
+
+func TestResolveThroughUnixSocketProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "networkresolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "socks")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Could not listen on unix socket: %v", err)
+	}
+	defer ln.Close()
+
+	requests := make(chan socksRequest, 1)
+	go fakeSOCKS5Proxy(ln, requests)
+
+	resolver := NetworkResolver{
+		ProxyNetwork: "unix",
+		ProxyAddress: socket,
+		ProxyAuth:    &proxy.Auth{User: "identity", Password: "isolation"},
+		RemotePort:   1234,
+	}
+	conn, hostname, err := resolver.Resolve("ricochet:jlq67qzo6s4yp3sp")
+	if err != nil {
+		t.Fatalf("Could not resolve through proxy: %v", err)
+	}
+	defer conn.Close()
+
+	request := <-requests
+	if hostname != "jlq67qzo6s4yp3sp" {
+		t.Errorf("Resolved hostname %v, expected jlq67qzo6s4yp3sp", hostname)
+	}
+	if request.host != "jlq67qzo6s4yp3sp.onion" || request.port != 1234 {
+		t.Errorf("Proxy was asked to connect to %v:%v", request.host, request.port)
+	}
+	if request.user != "identity" || request.pass != "isolation" {
+		t.Errorf("Proxy received credentials %v:%v", request.user, request.pass)
+	}
+}
+
+func TestParseOnionHostname(t *testing.T) {
+	for _, hostname := range []string{
+		"jlq67qzo6s4yp3sp",
+		"ricochet:jlq67qzo6s4yp3sp",
+		"jlq67qzo6s4yp3sp.onion",
+		"jlq67qzo6s4yp3sp.onion:9878",
+		"JLQ67QZO6S4YP3SP.onion",
+		"127.0.0.1:9878|jlq67qzo6s4yp3sp",
+	} {
+		if parsed := ParseOnionHostname(hostname); parsed != "jlq67qzo6s4yp3sp" {
+			t.Errorf("ParseOnionHostname(%q) = %q, expected jlq67qzo6s4yp3sp", hostname, parsed)
+		}
+	}
+}
+
+func TestResolveOnionHostnameForms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "networkresolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, form := range []struct {
+		hostname string
+		port     int
+	}{
+		{"jlq67qzo6s4yp3sp", 1234},
+		{"ricochet:jlq67qzo6s4yp3sp", 1234},
+		{"JLQ67QZO6S4YP3SP.onion", 1234},
+		{"jlq67qzo6s4yp3sp.onion:9878", 9878},
+		{"ricochet:jlq67qzo6s4yp3sp.onion:9878", 9878},
+	} {
+		socket := filepath.Join(dir, "socks"+strconv.Itoa(i))
+		ln, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatalf("Could not listen on unix socket: %v", err)
+		}
+		requests := make(chan socksRequest, 1)
+		go fakeSOCKS5Proxy(ln, requests)
+
+		resolver := NetworkResolver{
+			ProxyNetwork: "unix",
+			ProxyAddress: socket,
+			ProxyAuth:    &proxy.Auth{User: "identity", Password: "isolation"},
+			RemotePort:   1234,
+		}
+		conn, hostname, err := resolver.Resolve(form.hostname)
+		if err != nil {
+			t.Fatalf("Could not resolve %v: %v", form.hostname, err)
+		}
+		request := <-requests
+		conn.Close()
+		ln.Close()
+
+		if hostname != "jlq67qzo6s4yp3sp" {
+			t.Errorf("Resolved %v to hostname %v, expected jlq67qzo6s4yp3sp", form.hostname, hostname)
+		}
+		if request.host != "jlq67qzo6s4yp3sp.onion" || request.port != form.port {
+			t.Errorf("Resolving %v asked the proxy to connect to %v:%v", form.hostname, request.host, request.port)
+		}
+	}
+}
@@ -2,10 +2,14 @@ package utils
 
 import (
 	"crypto/sha1"
+	"crypto/sha3"
 	"encoding/base32"
 	"strings"
 )
 
+// torV3Version is the version byte of a version 3 onion hostname.
+const torV3Version = 0x03
+
 // GetTorHostname takes a []byte contained a DER-encoded RSA public key
 // and returns the first 16 bytes of the base32 encoded sha1 hash of the key.
 // This is the onion hostname of the tor service represented by the public key.
@@ -17,3 +21,20 @@ func GetTorHostname(publicKeyBytes []byte) string {
 	data := base32.StdEncoding.EncodeToString(sha1bytes)
 	return strings.ToLower(data[0:16])
 }
+
+// GetTorV3Hostname takes a 32 byte ed25519 public key and returns the 56
+// character onion hostname of the version 3 tor service represented by it:
+// base32(publicKey | checksum | version), where checksum is the first 2 bytes
+// of SHA3-256(".onion checksum" | publicKey | version).
+func GetTorV3Hostname(publicKey []byte) string {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(publicKey)
+	h.Write([]byte{torV3Version})
+	checksum := h.Sum(nil)
+
+	data := make([]byte, 0, len(publicKey)+3)
+	data = append(data, publicKey...)
+	data = append(data, checksum[0], checksum[1], torV3Version)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(data))
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/asn1"
+	"encoding/hex"
 	"encoding/pem"
 	"testing"
 )
@@ -41,3 +42,13 @@ func TestGetTorHostname(t *testing.T) {
 		t.Errorf("Hostname %s does not equal %s", hostname, "kwke2hntvyfqm7dr")
 	}
 }
+
+func TestGetTorV3Hostname(t *testing.T) {
+	// The public key of test vector 1 of RFC 8032
+	publicKey, _ := hex.DecodeString("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+
+	hostname := GetTorV3Hostname(publicKey)
+	if hostname != "25njqamcweflpvkl73j4szahhihoc4xt3ktcgjnpaingr5yhkenl5sid" {
+		t.Errorf("Hostname %s does not equal %s", hostname, "25njqamcweflpvkl73j4szahhihoc4xt3ktcgjnpaingr5yhkenl5sid")
+	}
+}
@@ -0,0 +1,256 @@
+// Package torcontrol implements the small subset of the Tor control protocol
+// needed to publish a ricochet service as an onion service.
+package torcontrol
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultControlAddress is the default address of Tor's control port.
+const DefaultControlAddress = "127.0.0.1:9051"
+
+// ProtocolInfo describes how a controller may authenticate to Tor.
+type ProtocolInfo struct {
+	AuthMethods []string
+	CookieFile  string
+	Version     string
+}
+
+// HasAuthMethod returns true if Tor accepts the given authentication method.
+func (pi *ProtocolInfo) HasAuthMethod(method string) bool {
+	for _, m := range pi.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection to Tor's control port.
+type Conn struct {
+	conn *textproto.Conn
+}
+
+// Dial connects to the Tor control port at address on the given network
+// ("tcp" or "unix").
+func Dial(network string, address string) (*Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NewConn wraps an existing connection to the Tor control port.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: textproto.NewConn(conn)}
+}
+
+// Close closes the control connection. Tor removes any onion services added
+// on this connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// command sends a single command and returns the lines of a successful reply.
+func (c *Conn) command(format string, args ...interface{}) ([]string, error) {
+	id, err := c.conn.Cmd(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	c.conn.StartResponse(id)
+	defer c.conn.EndResponse(id)
+
+	_, message, err := c.conn.ReadResponse(250)
+	if err != nil {
+		if tpErr, ok := err.(*textproto.Error); ok {
+			return nil, errors.New("tor control error " + strconv.Itoa(tpErr.Code) + ": " + tpErr.Msg)
+		}
+		return nil, err
+	}
+	return strings.Split(message, "\n"), nil
+}
+
+// ProtocolInfo asks Tor which authentication methods it supports.
+func (c *Conn) ProtocolInfo() (*ProtocolInfo, error) {
+	lines, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return nil, err
+	}
+
+	pi := new(ProtocolInfo)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "AUTH ") {
+			for _, field := range strings.Fields(line[len("AUTH "):]) {
+				if strings.HasPrefix(field, "METHODS=") {
+					pi.AuthMethods = strings.Split(field[len("METHODS="):], ",")
+				}
+			}
+			if i := strings.Index(line, "COOKIEFILE="); i != -1 {
+				pi.CookieFile, err = unquote(line[i+len("COOKIEFILE="):])
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else if strings.HasPrefix(line, "VERSION Tor=") {
+			pi.Version, _ = unquote(line[len("VERSION Tor="):])
+		}
+	}
+	return pi, nil
+}
+
+// Authenticate authenticates the connection using the best method Tor offers:
+// no authentication, the cookie file, or the given password.
+func (c *Conn) Authenticate(password string) error {
+	pi, err := c.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+
+	if pi.HasAuthMethod("NULL") {
+		_, err = c.command("AUTHENTICATE")
+		return err
+	}
+	if pi.HasAuthMethod("COOKIE") && pi.CookieFile != "" {
+		return c.authenticateCookie(pi.CookieFile)
+	}
+	if pi.HasAuthMethod("HASHEDPASSWORD") {
+		return c.AuthenticatePassword(password)
+	}
+	return errors.New("no supported tor control authentication method")
+}
+
+// AuthenticateCookie authenticates the connection using the contents of Tor's
+// control auth cookie file.
+func (c *Conn) AuthenticateCookie() error {
+	pi, err := c.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+	if !pi.HasAuthMethod("COOKIE") || pi.CookieFile == "" {
+		return errors.New("tor does not support cookie authentication")
+	}
+	return c.authenticateCookie(pi.CookieFile)
+}
+
+func (c *Conn) authenticateCookie(cookieFile string) error {
+	cookie, err := ioutil.ReadFile(cookieFile)
+	if err != nil {
+		return err
+	}
+	_, err = c.command("AUTHENTICATE %s", hex.EncodeToString(cookie))
+	return err
+}
+
+// AuthenticatePassword authenticates the connection with the given password
+// (the plain text of Tor's HashedControlPassword). Passwords containing line
+// breaks or NUL cannot be sent and are refused.
+func (c *Conn) AuthenticatePassword(password string) error {
+	quoted, err := quote(password)
+	if err != nil {
+		return err
+	}
+	_, err = c.command("AUTHENTICATE %s", quoted)
+	return err
+}
+
+// AddOnion publishes an onion service for key, forwarding virtualPort on the
+// onion to target (e.g. "127.0.0.1:12345"). The service is removed when this
+// connection closes. Returns the service id (onion hostname) Tor reports.
+// Targets containing spaces, quotes, backslashes, commas or control characters,
+// such as some unix socket paths, cannot be sent and are refused.
+func (c *Conn) AddOnion(key crypto.PrivateKey, virtualPort int, target string) (string, error) {
+	if strings.ContainsAny(target, " \"\\,") || strings.IndexFunc(target, unicode.IsControl) != -1 {
+		return "", errors.New("unsupported onion service target: " + strconv.Quote(target))
+	}
+	keyBlob, err := onionKeyBlob(key)
+	if err != nil {
+		return "", err
+	}
+
+	lines, err := c.command("ADD_ONION %s Port=%d,%s", keyBlob, virtualPort, target)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "ServiceID=") {
+			return line[len("ServiceID="):], nil
+		}
+	}
+	return "", errors.New("tor did not return a service id")
+}
+
+// DelOnion removes an onion service previously added with AddOnion.
+func (c *Conn) DelOnion(serviceID string) error {
+	_, err := c.command("DEL_ONION %s", serviceID)
+	return err
+}
+
+// onionKeyBlob encodes a private key in the KeyType:KeyBlob form used by ADD_ONION.
+func onionKeyBlob(key crypto.PrivateKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return "RSA1024:" + base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PrivateKey(k)), nil
+	case ed25519.PrivateKey:
+		return "ED25519-V3:" + base64.StdEncoding.EncodeToString(expandEd25519Key(k)), nil
+	}
+	return "", errors.New("unsupported onion service key type")
+}
+
+// expandEd25519Key returns the 64 byte expanded form of key used by Tor: the
+// clamped scalar followed by the hash prefix, both derived from the seed.
+func expandEd25519Key(key ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(key.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:]
+}
+
+// quote encodes s as a control protocol QuotedString. Tor's handling of
+// escaped line breaks varies between versions, so strings containing CR, LF
+// or NUL are refused rather than escaped.
+func quote(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		return "", errors.New("string cannot be sent to the tor control port")
+	}
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\"", nil
+}
+
+// unquote decodes the QuotedString at the start of s.
+func unquote(s string) (string, error) {
+	if !strings.HasPrefix(s, "\"") {
+		return "", errors.New("expected quoted string")
+	}
+	var value []byte
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				value = append(value, s[i])
+			}
+		case '"':
+			return string(value), nil
+		default:
+			value = append(value, s[i])
+		}
+	}
+	return "", errors.New("unterminated quoted string")
+}